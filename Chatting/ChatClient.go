@@ -6,73 +6,137 @@ package main
 
 import (
 	"bufio"
-	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/exec"
 	"os/signal"
-	"regexp"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode/utf8"
+
+	"github.com/young-jin-son/Network-Practice/Chatting/client"
+	"github.com/young-jin-son/Network-Practice/Chatting/e2e"
+	"github.com/young-jin-son/Network-Practice/Chatting/filetransfer"
+	"github.com/young-jin-son/Network-Practice/Chatting/protocol"
+	"github.com/young-jin-son/Network-Practice/Chatting/tlsutil"
+	"github.com/young-jin-son/Network-Practice/Chatting/tui"
+	"github.com/young-jin-son/Network-Practice/config"
 )
 
-/* Request Code *
- * 0: make new connection
- * 1: default (send to all)
- * 2: "\ls" command
- * 3: "\secret" command
- * 4: "\except" command
- * 5: "\ping" command
- * 6: "\quit" command */
-type Request struct {
-	Header struct {
-		Code     byte   `json:"code"`
-		Sender   string `json:"sender"`
-		Receiver string `json:"receiver"`
-	} `json:"header"`
-	Body struct {
-		Message string `json:"message"`
-	} `json:"body"`
-}
-
-/* Response Code *
- * 0: for RTT
- * 1: response for my request
- * 2: message from other clients
- * 3: something bad
- * 4: server terminated */
-type Response struct {
-	Code    byte   `json:"code"`
-	Message string `json:"message"`
-}
+var serverName = "nsl2.cau.ac.kr"
+var serverPort = "30768"
+
+/* Reconnecting *
+ * autoReconnect: redial with backoff when the connection drops, resuming the session
+ * maxBackoff: longest wait between attempts
+ * serverTimeout: treat the connection as dead after this long without a frame (the server sends heartbeats) */
+var autoReconnect = true
+var maxBackoff = 30 * time.Second
+var serverTimeout = 2 * time.Minute
+
+var operatorPassword = ""
+var password = ""
+
+var useTLS = false
+var tlsOptions tlsutil.ClientOptions
+
+/* End-to-end encryption of \secret *
+ * identityFile: our own keys, created on first run
+ * knownKeysFile: keys of people we have talked to (trust on first use) */
+var useE2E = true
+var identityFile = ""
+var knownKeysFile = ""
+var identity *e2e.Identity
+var knownKeys *e2e.KeyStore
+
+// Where accepted files are saved.
+var downloadsDir = "downloads"
+
+/* Full-screen mode *
+ * useTUI: draw a message pane, a user sidebar and an input line instead of plain lines
+ * quietLists: \ls requests sent to refresh the sidebar, whose replies aren't shown */
+var useTUI = false
+var screen *tui.Screen
+var quietLists atomic.Int32
+
+const usersRefresh = 5 * time.Second
+
+/* Bot mode *
+ * useJSON: read requests as JSON lines on stdin and print every response as a JSON line,
+ * for scripts and bots. No prompts, no commands and no end-to-end encryption. */
+var useJSON = false
 
 func main() {
+	flag.StringVar(&serverName, "server", serverName, "chat server host name")
+	flag.StringVar(&serverPort, "port", serverPort, "chat server port")
+	flag.BoolVar(&autoReconnect, "reconnect", autoReconnect, "reconnect and resume the session when the connection drops")
+	flag.DurationVar(&maxBackoff, "maxbackoff", maxBackoff, "longest wait between reconnect attempts")
+	flag.DurationVar(&serverTimeout, "servertimeout", serverTimeout, "give up on a server that sends nothing for this long (0 to wait forever)")
+	flag.IntVar(&protocol.MaxFrameSize, "maxframe", protocol.MaxFrameSize, "maximum size of a single request/response in bytes")
+	flag.StringVar(&operatorPassword, "oper", operatorPassword, "operator password to join with")
+	flag.StringVar(&password, "password", password, "password of your registered nickname")
+	flag.BoolVar(&useTLS, "tls", useTLS, "connect with TLS")
+	flag.StringVar(&tlsOptions.CAFile, "ca", "", "trust server certificates signed by this CA (implies -tls)")
+	flag.StringVar(&tlsOptions.Pin, "pin", "", "trust only the server certificate with this SHA-256 fingerprint (implies -tls)")
+	flag.StringVar(&tlsOptions.CertFile, "cert", "", "client certificate for mutual TLS (implies -tls)")
+	flag.StringVar(&tlsOptions.KeyFile, "key", "", "client private key for mutual TLS")
+	flag.BoolVar(&useE2E, "e2e", useE2E, "encrypt secret messages end to end")
+	flag.StringVar(&identityFile, "identity", "", "file holding your encryption keys (default ~/.chat/<nickname>.key)")
+	flag.StringVar(&knownKeysFile, "knownkeys", "", "file holding keys of other users (default ~/.chat/known_keys.json)")
+	flag.StringVar(&downloadsDir, "downloads", downloadsDir, "directory to save accepted files in")
+	flag.BoolVar(&useTUI, "tui", useTUI, "full-screen interface with a user list (needs a terminal)")
+	flag.BoolVar(&useJSON, "json", useJSON, "read requests as JSON lines on stdin and print responses as JSON lines")
+	if err := config.Parse("chatclient"); err != nil {
+		fmt.Println("Error reading configuration:", err)
+		os.Exit(1)
+	}
+
 	// Check nickname.
-	if len(os.Args) < 2 {
+	if flag.NArg() < 1 {
 		fmt.Println("Please enter your nickname.")
 		os.Exit(0)
 	}
 
-	nickname := os.Args[1]
+	nickname := flag.Arg(0)
 	if isValidNickname(nickname) == false {
 		fmt.Println("Please enter a valid nickname.\n(English only, 32 characters or less)")
 		os.Exit(0)
 	}
 
-	// Connect to server.
-	serverName := "nsl2.cau.ac.kr"
-	serverPort := "30768"
+	if useJSON {
+		os.Exit(runJSON(nickname))
+	}
+
+	setupTerminal(nickname)
+	defer restoreTerminal()
 
-	conn, err := net.Dial("tcp", serverName+":"+serverPort)
+	if useE2E {
+		if err := loadKeys(nickname); err != nil {
+			fmt.Println("Error loading encryption keys:", err)
+			terminate(1)
+		}
+	}
+
+	// Connect to server.
+	c, err := connect(nickname)
 	if err != nil {
-		fmt.Println("Error connecting to server.")
+		fmt.Println("Error connecting to server:", err)
 		return
 	}
-	defer conn.Close()
 
-	initConn(conn, nickname)
+	if screen != nil {
+		go refreshUsers(c, nickname)
+	}
 
 	// Exits when Ctrl-C is entered.
 	sig := make(chan os.Signal, 1)
@@ -81,34 +145,101 @@ func main() {
 	go func() {
 		<-sig
 		fmt.Printf("\n\n")
-		request, _ := newRequest(byte(6), nickname, "", "")
-		exit(conn, request)
-		os.Exit(0)
+		exit(c)
 	}()
 
 	sendTime := time.Now()
 
-	// Receive messages.
+	// Receive messages. Heartbeats and reconnecting are left to the client library.
 	go func() {
-		for {
-			responses := receiveRes(conn)
-			for _, response := range responses {
-				if response.Code == 0 { // ping
-					rtt := time.Since(sendTime)
-					fmt.Printf("RTT = %.3f ms\n\n", float64(rtt.Microseconds())/1000)
-				} else if response.Code == 2 {
-					fmt.Printf("%s\n\n", response.Message)
-				} else if response.Code == 3 || response.Code == 4 {
-					fmt.Printf("%s\n\n", response.Message)
-					os.Exit(0)
+		err := c.Handle(func(response protocol.Response) {
+			if response.Code == protocol.ResRTT { // ping
+				rtt := time.Since(sendTime)
+				fmt.Printf("RTT = %.3f ms\n\n", float64(rtt.Microseconds())/1000)
+			} else if response.Code == protocol.ResMessage && response.ID != 0 { // chat message, with the ID to \edit or \react to it by
+				kind := tui.Broadcast
+				if response.Private {
+					kind = tui.Secret
+				}
+				showMessage(kind, fmt.Sprintf("#%d %s", response.ID, response.Message))
+				if response.Private {
+					markRead(c, nickname, response)
+				}
+			} else if response.Code == protocol.ResMessage && response.Members != nil { // \ls
+				if screen != nil {
+					screen.SetUsers(response.Members)
+				}
+				if quietLists.Load() > 0 {
+					quietLists.Add(-1)
+				} else {
+					showMessage(tui.System, response.Message)
+				}
+			} else if response.Code == protocol.ResReply || response.Code == protocol.ResMessage {
+				showMessage(tui.System, response.Message)
+				if response.Private {
+					markRead(c, nickname, response)
 				}
+			} else if response.Code == protocol.ResTyping {
+				showTyping(response.Sender, response.Private)
+			} else if response.Code == protocol.ResReceipt && response.Message == protocol.ReceiptRead {
+				fmt.Printf("[message #%d read by %s.]\n\n", response.ID, response.Sender)
+			} else if response.Code == protocol.ResReceipt && response.Message == protocol.ReceiptSent {
+				fmt.Printf("[sent #%d]\n\n", response.ID)
+			} else if response.Code == protocol.ResReceipt {
+				fmt.Printf("[message #%d delivered to %s.]\n\n", response.ID, response.Sender)
+			} else if response.Code == protocol.ResEdited {
+				fmt.Printf("[%s edited #%d]> %s\n\n", response.Sender, response.ID, response.Message)
+			} else if response.Code == protocol.ResDeleted {
+				fmt.Printf("[%s deleted #%d]\n\n", response.Sender, response.ID)
+			} else if response.Code == protocol.ResReaction {
+				fmt.Printf("[%s reacted %s to #%d]\n\n", response.Sender, response.Message, response.ID)
+			} else if response.Code == protocol.ResPublicKey {
+				receivedKey(c, nickname, response.Sender, response.PublicKey)
+			} else if response.Code == protocol.ResEncrypted {
+				receivedSecret(c, nickname, response)
+			} else if response.Code == protocol.ResTargetError {
+				fmt.Printf("%s\n\n", response.Message)
+				droppedTarget(response.Target)
+			} else if response.Code == protocol.ResGroup {
+				receivedGroup(c, nickname, response.Target, response.Members)
+			} else if response.Code == protocol.ResUpload {
+				startUpload(nickname, response)
+			} else if response.Code == protocol.ResOffer {
+				receivedOffer(response)
+			} else if (response.Code == protocol.ResTerminated || response.Code == protocol.ResError) && autoReconnect && !client.Final(response) {
+				fmt.Printf("%s\n\n", response.Message) // reconnects if the server closes the connection
+			} else if response.Code == protocol.ResError || response.Code == protocol.ResTerminated {
+				fmt.Printf("%s\n\n", response.Message)
+				terminate(0)
 			}
+		})
+		if errors.Is(err, client.ErrClosed) { // \quit or Ctrl-C, exit is on its way out
+			return
 		}
+		fmt.Printf("[Disconnected from server: %v]\n\n", err)
+		terminate(0)
 	}()
 
+	// Tell the room, or the receiver of a \secret, that we're typing.
+	typing := func(line string) bool {
+		receiver := ""
+		if strings.HasPrefix(line, "\\") {
+			fields := strings.Fields(line)
+			if fields[0] != "\\secret" || len(fields) < 3 {
+				return false
+			}
+			receiver = fields[1]
+		}
+		request := protocol.NewRequest(protocol.ReqTyping, nickname, "", "")
+		if receiver != "" {
+			request.Header.Receivers = splitTargets(receiver)
+		}
+		return sendReq(c, request) == nil
+	}
+
 	// Send Requests.
 	for {
-		input, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		input, _ := readLine(typing)
 		input = strings.TrimSpace(input)
 		fmt.Printf("\n")
 
@@ -121,31 +252,181 @@ func main() {
 
 			switch command {
 			case "\\ls":
-				request, _ := newRequest(2, nickname, receiver, message)
-				sendReq(conn, request)
+				request := protocol.NewRequest(protocol.ReqList, nickname, receiver, message)
+				sendReq(c, request)
 
 			case "\\secret":
-				receiver = split[1]
+				if len(split) < 3 {
+					fmt.Printf("Usage: \\secret <nickname|@group>[,...] <message>\n\n")
+					continue
+				}
+				targets := splitTargets(split[1])
 				message = strings.Join(split[2:], " ")
 
-				request, _ := newRequest(3, nickname, receiver, message)
-				sendReq(conn, request)
+				if identity != nil {
+					for _, target := range targets {
+						if strings.HasPrefix(target, protocol.GroupPrefix) {
+							sendGroupSecret(c, nickname, target, message)
+						} else {
+							sendSecret(c, nickname, target, message)
+						}
+					}
+				} else {
+					request := protocol.NewRequest(protocol.ReqSecret, nickname, receiver, message)
+					request.Header.Receivers = targets
+					sendReq(c, request)
+				}
+
+			case "\\trust":
+				if len(split) < 2 {
+					fmt.Printf("Usage: \\trust <nickname>\n\n")
+					continue
+				}
+				trustKey(c, nickname, split[1])
+
+			case "\\plaintext":
+				if len(split) < 2 {
+					fmt.Printf("Usage: \\plaintext <nickname>\n\n")
+					continue
+				}
+				sendUnencrypted(c, nickname, split[1])
 
 			case "\\except":
+				if len(split) < 3 {
+					fmt.Printf("Usage: \\except <nickname|@group>[,...] <message>\n\n")
+					continue
+				}
+				message = strings.Join(split[2:], " ")
+
+				request := protocol.NewRequest(protocol.ReqExcept, nickname, receiver, message)
+				request.Header.Receivers = splitTargets(split[1])
+				sendReq(c, request)
+
+			case "\\group":
+				if len(split) < 2 || (split[1] != protocol.GroupList && len(split) < 3) {
+					fmt.Printf("Usage: \\group create|add|remove <group> <nickname>...\n       \\group delete|show <group>\n       \\group list\n\n")
+					continue
+				}
+				message = split[1]
+				if len(split) > 2 {
+					receiver = split[2]
+				}
+
+				request := protocol.NewRequest(protocol.ReqGroup, nickname, receiver, message)
+				if len(split) > 3 {
+					request.Header.Receivers = split[3:]
+				}
+				sendReq(c, request)
+
+			case "\\create":
+				if len(split) < 2 {
+					fmt.Printf("Usage: \\create <room> [limit]\n\n")
+					continue
+				}
+				receiver = split[1]
+				if len(split) > 2 {
+					message = split[2]
+				}
+
+				request := protocol.NewRequest(protocol.ReqCreateRoom, nickname, receiver, message)
+				sendReq(c, request)
+
+			case "\\join":
+				if len(split) < 2 {
+					fmt.Printf("Usage: \\join <room>\n\n")
+					continue
+				}
+				receiver = split[1]
+
+				request := protocol.NewRequest(protocol.ReqJoinRoom, nickname, receiver, message)
+				sendReq(c, request)
+
+			case "\\leave":
+				request := protocol.NewRequest(protocol.ReqLeaveRoom, nickname, receiver, message)
+				sendReq(c, request)
+
+			case "\\rooms":
+				request := protocol.NewRequest(protocol.ReqListRooms, nickname, receiver, message)
+				sendReq(c, request)
+
+			case "\\history":
+				if len(split) > 1 {
+					message = split[1]
+				}
+
+				request := protocol.NewRequest(protocol.ReqHistory, nickname, receiver, message)
+				sendReq(c, request)
+
+			case "\\kick", "\\ban", "\\unban", "\\mute", "\\setlimit":
+				if len(split) < 2 {
+					fmt.Printf("Usage: %s\n\n", operatorUsage[command])
+					continue
+				}
 				receiver = split[1]
 				message = strings.Join(split[2:], " ")
 
-				request, _ := newRequest(4, nickname, receiver, message)
-				sendReq(conn, request)
+				request := protocol.NewRequest(operatorCodes[command], nickname, receiver, message)
+				sendReq(c, request)
+
+			case "\\announce":
+				message = strings.Join(split[1:], " ")
+				if message == "" {
+					fmt.Printf("Usage: %s\n\n", operatorUsage[command])
+					continue
+				}
+
+				request := protocol.NewRequest(protocol.ReqAnnounce, nickname, receiver, message)
+				sendReq(c, request)
+
+			case "\\register":
+				if len(split) < 2 || split[1] == "" {
+					fmt.Printf("Usage: \\register <password>\n\n")
+					continue
+				}
+
+				request := protocol.NewRequest(protocol.ReqRegister, nickname, receiver, message)
+				request.Body.Password = split[1]
+				sendReq(c, request)
+
+			case "\\edit", "\\delete", "\\react":
+				if len(split) < 2 || (command != "\\delete" && len(split) < 3) {
+					fmt.Printf("Usage: %s\n\n", changeUsage[command])
+					continue
+				}
+				receiver = strings.TrimPrefix(split[1], "#")
+				message = strings.Join(split[2:], " ")
+
+				request := protocol.NewRequest(changeCodes[command], nickname, receiver, message)
+				sendReq(c, request)
+
+			case "\\send":
+				if len(split) < 3 {
+					fmt.Printf("Usage: \\send <nickname|all> <path>\n\n")
+					continue
+				}
+				offerFile(c, nickname, split[1], strings.Join(split[2:], " "))
+
+			case "\\accept":
+				if len(split) < 2 {
+					fmt.Printf("Usage: \\accept <id>\n\n")
+					continue
+				}
+				acceptFile(nickname, split[1])
+
+			case "\\decline":
+				if len(split) < 2 {
+					fmt.Printf("Usage: \\decline <id>\n\n")
+					continue
+				}
+				declineFile(c, nickname, split[1])
 
 			case "\\ping":
 				sendTime = time.Now()
-				request, _ := newRequest(5, nickname, receiver, message)
-				sendReq(conn, request)
+				request := protocol.NewRequest(protocol.ReqPing, nickname, receiver, message)
+				sendReq(c, request)
 
 			case "\\quit":
-				request, _ := newRequest(6, nickname, receiver, message)
-				exit(conn, request)
+				exit(c)
 
 			default:
 				fmt.Printf("Invalid command.\n\n")
@@ -154,101 +435,790 @@ func main() {
 
 		} else { // No command, broadcast message
 			message = input
-			request, _ := newRequest(1, nickname, receiver, message)
-			sendReq(conn, request)
+			request := protocol.NewRequest(protocol.ReqBroadcast, nickname, receiver, message)
+			sendReq(c, request)
 		}
 	}
 }
 
+/* Commands that change a message, by the ID shown next to it. */
+var changeCodes = map[string]protocol.RequestCode{
+	"\\edit":   protocol.ReqEdit,
+	"\\delete": protocol.ReqDelete,
+	"\\react":  protocol.ReqReact,
+}
+
+var changeUsage = map[string]string{
+	"\\edit":   "\\edit <id> <new text>",
+	"\\delete": "\\delete <id>",
+	"\\react":  "\\react <id> <emoji>",
+}
+
+/* Operator commands. The server refuses them from non-operators. */
+var operatorCodes = map[string]protocol.RequestCode{
+	"\\kick":     protocol.ReqKick,
+	"\\ban":      protocol.ReqBan,
+	"\\unban":    protocol.ReqUnban,
+	"\\mute":     protocol.ReqMute,
+	"\\announce": protocol.ReqAnnounce,
+	"\\setlimit": protocol.ReqSetLimit,
+}
+
+var operatorUsage = map[string]string{
+	"\\kick":     "\\kick <nickname> [reason]",
+	"\\ban":      "\\ban <nickname|ip>",
+	"\\unban":    "\\unban <nickname|ip>",
+	"\\mute":     "\\mute <nickname> [duration, e.g. 10m; 0 to unmute]",
+	"\\announce": "\\announce <message>",
+	"\\setlimit": "\\setlimit <room> <limit>",
+}
+
 /** max length of <= 32, English nickname, no spaces or special char in nickname. */
 func isValidNickname(userNickname string) bool {
-	length := len(userNickname)
-	if length > 32 {
-		return false
+	return protocol.ValidNickname(userNickname)
+}
+
+/** Connect to the server on port, over TLS if any TLS flag was given. Used for file data connections. **/
+func dial(serverName string, port string) (net.Conn, error) {
+	address := net.JoinHostPort(serverName, port)
+
+	config, err := tlsConfig(serverName)
+	if err != nil {
+		return nil, err
+	} else if config == nil {
+		return net.Dial("tcp", address)
+	}
+	return tls.Dial("tcp", address, config)
+}
+
+/** Return the TLS settings from the flags, nil if no TLS flag was given. **/
+func tlsConfig(serverName string) (*tls.Config, error) {
+	if !useTLS && tlsOptions.CAFile == "" && tlsOptions.Pin == "" && tlsOptions.CertFile == "" {
+		return nil, nil
+	}
+
+	tlsOptions.ServerName = serverName
+	return tlsutil.ClientConfig(tlsOptions)
+}
+
+/** Return the client settings from the flags. **/
+func clientConfig(nickname string) (client.Config, error) {
+	tlsSettings, err := tlsConfig(serverName)
+	if err != nil {
+		return client.Config{}, err
+	}
+
+	return client.Config{
+		Server:           serverName,
+		Port:             serverPort,
+		Nickname:         nickname,
+		Password:         password,
+		OperatorPassword: operatorPassword,
+		TLS:              tlsSettings,
+		ServerTimeout:    serverTimeout,
+		Reconnect:        autoReconnect,
+		MaxBackoff:       maxBackoff,
+	}, nil
+}
+
+/** Connect and join, showing the server's welcome. Exits if the server refuses us. The client reconnects and resumes the session by itself. **/
+func connect(nickname string) (*client.Client, error) {
+	config, err := clientConfig(nickname)
+	if err != nil {
+		return nil, err
+	}
+	if identity != nil {
+		config.PublicKey = identity.Public().String()
 	}
 
-	for i := 0; i < length; i++ {
-		matched, _ := regexp.MatchString("[a-zA-Z]", string(userNickname[i]))
-		if matched == false {
-			return false
+	config.OnReconnecting = func(attempt int, err error) {
+		if attempt == 1 {
+			fmt.Printf("[Disconnected from server. reconnecting...]\n\n")
+		} else {
+			fmt.Printf("[Reconnect attempt %d failed: %v]\n\n", attempt-1, err)
 		}
 	}
+	config.OnReconnected = func(welcome protocol.Response) {
+		quietLists.Store(0) // their replies went with the old connection
+		if welcome.Message != "" {
+			fmt.Printf("\n%s\n\n", welcome.Message)
+		}
+	}
+
+	c, welcome, err := client.Dial(config)
+	if welcome.Message != "" {
+		fmt.Printf("\n%s\n\n", welcome.Message)
+	}
 
-	return true
+	if errors.Is(err, client.ErrRefused) { // Something wrong
+		terminate(0)
+	}
+	return c, err
 }
 
-/** Return a request packet. **/
-func newRequest(code byte, sender string, receiver string, message string) ([]byte, error) {
-	request := Request{
-		Header: struct {
-			Code     byte   `json:"code"`
-			Sender   string `json:"sender"`
-			Receiver string `json:"receiver"`
-		}{Code: code, Sender: sender, Receiver: receiver},
-		Body: struct {
-			Message string `json:"message"`
-		}{Message: message},
+/** Load our identity and the known keys, creating them on first run. **/
+func loadKeys(nickname string) error {
+	if identityFile == "" || knownKeysFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		if identityFile == "" {
+			identityFile = filepath.Join(home, ".chat", nickname+".key")
+		}
+		if knownKeysFile == "" {
+			knownKeysFile = filepath.Join(home, ".chat", "known_keys.json")
+		}
 	}
 
-	return json.Marshal(request)
+	id, err := e2e.LoadOrCreate(identityFile)
+	if err != nil {
+		return err
+	}
+	keys, err := e2e.OpenKeyStore(knownKeysFile)
+	if err != nil {
+		return err
+	}
+
+	identity = id
+	knownKeys = keys
+	fmt.Printf("\nYour key fingerprint: %s\n", identity.Public().Fingerprint())
+	return nil
+}
+
+/* Secrets waiting for a key from the server *
+ * outgoing: messages to seal once we know the receiver's key
+ * incoming: sealed messages to open once we know the sender's key
+ * changed: keys that differ from the saved ones, until the user runs \trust
+ * unencrypted: messages to receivers who never had a key, until the user runs \plaintext
+ * groups: messages for a group, to seal for each member once we know who is in it */
+type pendingSecrets struct {
+	mu          sync.Mutex
+	outgoing    map[string][]string
+	incoming    map[string][]protocol.Response
+	changed     map[string]e2e.PublicKey
+	unencrypted map[string][]string
+	groups      map[string][]string
+}
+
+var pending = pendingSecrets{
+	outgoing:    make(map[string][]string),
+	incoming:    make(map[string][]protocol.Response),
+	changed:     make(map[string]e2e.PublicKey),
+	unencrypted: make(map[string][]string),
+	groups:      make(map[string][]string),
+}
+
+/** Split "alice,bob,@devs" into its targets. **/
+func splitTargets(list string) []string {
+	var targets []string
+	for _, target := range strings.Split(list, ",") {
+		if target != "" {
+			targets = append(targets, target)
+		}
+	}
+	return targets
 }
 
-/** Initialize connection. **/
-func initConn(conn net.Conn, nickname string) {
-	packet, _ := newRequest(0, nickname, "", "")
+/** Queue an encrypted secret for each member of group and ask the server who they are. **/
+func sendGroupSecret(c *client.Client, nickname string, group string, message string) {
+	pending.mu.Lock()
+	pending.groups[group] = append(pending.groups[group], message)
+	pending.mu.Unlock()
 
-	if err := sendReq(conn, packet); err != nil {
-		fmt.Println("\nError sending request.\n")
+	request := protocol.NewRequest(protocol.ReqGroup, nickname, group, protocol.GroupShow)
+	sendReq(c, request)
+}
+
+/** Seal what was waiting for group for each of its members, or show them if nothing was. **/
+func receivedGroup(c *client.Client, nickname string, group string, members []string) {
+	pending.mu.Lock()
+	messages, waiting := pending.groups[group]
+	delete(pending.groups, group)
+	pending.mu.Unlock()
+
+	if !waiting {
+		fmt.Printf("[%s: %s]\n\n", group, strings.Join(members, ", "))
+		return
+	}
+	for _, member := range members {
+		if member == nickname {
+			continue
+		}
+		for _, message := range messages {
+			sendSecret(c, nickname, member, message)
+		}
+	}
+}
+
+/** Forget secrets waiting for a group the server says doesn't exist. **/
+func droppedTarget(target string) {
+	pending.mu.Lock()
+	delete(pending.groups, target)
+	pending.mu.Unlock()
+}
+
+/** Queue an encrypted secret and ask the server for the receiver's key. **/
+func sendSecret(c *client.Client, nickname string, receiver string, message string) {
+	pending.mu.Lock()
+	pending.outgoing[receiver] = append(pending.outgoing[receiver], message)
+	pending.mu.Unlock()
+
+	sendReq(c, protocol.NewRequest(protocol.ReqGetKey, nickname, receiver, ""))
+}
+
+/** Open a sealed secret, or wait for the sender's key if we can't yet. **/
+func receivedSecret(c *client.Client, nickname string, response protocol.Response) {
+	sender := response.Sender
+	key, ok := knownKeys.Get(sender)
+	if ok && identity != nil {
+		if text, err := e2e.Open(identity, nickname, key, sender, response.Message); err == nil {
+			showMessage(tui.Secret, fmt.Sprintf("#%d from: %s> %s [encrypted]", response.ID, sender, text))
+			markRead(c, nickname, response)
+			return
+		}
+	}
+
+	// Unknown sender or a key that no longer matches: fetch the current one first.
+	pending.mu.Lock()
+	pending.incoming[sender] = append(pending.incoming[sender], response)
+	pending.mu.Unlock()
+
+	sendReq(c, protocol.NewRequest(protocol.ReqGetKey, nickname, sender, ""))
+}
+
+/** Tell the sender of a secret we have shown it. **/
+func markRead(c *client.Client, nickname string, response protocol.Response) {
+	if response.ID == 0 || response.Sender == "" {
 		return
 	}
+	request := protocol.NewRequest(protocol.ReqRead, nickname, response.Sender, strconv.FormatUint(response.ID, 10))
+	sendReq(c, request)
+}
+
+/* Typing indicators are shown at most once per typingQuiet for each sender. */
+const typingQuiet = 5 * time.Second
 
-	buffer := make([]byte, 1024)
-	n, _ := conn.Read(buffer)
+var typingShown = make(map[string]time.Time)
+
+/** Show that sender is typing, to us alone if private. Called from the receive loop only. **/
+func showTyping(sender string, private bool) {
+	if time.Since(typingShown[sender]) < typingQuiet {
+		return
+	}
+	typingShown[sender] = time.Now()
 
-	var response Response
-	err := json.Unmarshal(buffer[:n], &response)
+	if private {
+		fmt.Printf("[%s is typing to you…]\n\n", sender)
+	} else {
+		fmt.Printf("[%s is typing…]\n\n", sender)
+	}
+}
+
+/** Check a key from the server against the known keys and flush what was waiting for it. **/
+func receivedKey(c *client.Client, nickname string, owner string, published string) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+
+	if published == "" {
+		if saved, pinned := knownKeys.Get(owner); pinned {
+			// We have talked to them encrypted before, so a missing key may be the server stripping it.
+			if count := len(pending.outgoing[owner]); count > 0 {
+				fmt.Printf("WARNING: the server says %s has no key, but you saved key %s for them!\n", owner, saved.Fingerprint())
+				fmt.Printf("Someone may be pretending to be %s. %d secret message(s) to them were not sent.\n\n", owner, count)
+			}
+		} else if count := len(pending.outgoing[owner]); count > 0 {
+			// Receiver never had a key (old client or -e2e=false): send in plaintext only if the user says so.
+			pending.unencrypted[owner] = append(pending.unencrypted[owner], pending.outgoing[owner]...)
+			fmt.Printf("[%s has no encryption key. The server could read your secret; run \\plaintext %s to send %d message(s) unencrypted.]\n\n",
+				owner, owner, len(pending.unencrypted[owner]))
+		}
+		for range pending.incoming[owner] {
+			fmt.Printf("[Dropped an encrypted message from %s: they have no key to verify it.]\n\n", owner)
+		}
+		delete(pending.outgoing, owner)
+		delete(pending.incoming, owner)
+		return
+	}
+
+	key, err := e2e.ParsePublicKey(published)
 	if err != nil {
-		fmt.Println("Error decoding response:", err)
-		os.Exit(1)
+		fmt.Printf("[Server sent a bad key for %s. secret messages to or from them were not sent.]\n\n", owner)
+		delete(pending.outgoing, owner)
+		delete(pending.incoming, owner)
+		return
 	}
 
-	fmt.Printf("\n%s\n\n", response.Message)
+	trust, err := knownKeys.Check(owner, key)
+	if err != nil {
+		fmt.Println("Error saving known keys:", err)
+	}
 
-	if response.Code == 3 { // Something wrong
-		os.Exit(0)
+	if trust == e2e.TrustChanged {
+		old, _ := knownKeys.Get(owner)
+		pending.changed[owner] = key
+		fmt.Printf("WARNING: the key of %s has changed!\n", owner)
+		fmt.Printf("  saved:    %s\n", old.Fingerprint())
+		fmt.Printf("  received: %s\n", key.Fingerprint())
+		fmt.Printf("Someone may be pretending to be %s. Check the new fingerprint with them, then run \\trust %s to accept it.\n\n", owner, owner)
+		return
+	} else if trust == e2e.TrustNew {
+		fmt.Printf("[First message with %s. key fingerprint: %s]\n\n", owner, key.Fingerprint())
 	}
+
+	flushSecrets(c, nickname, owner, key)
 }
 
-/** Send request to server and return error */
-func sendReq(conn net.Conn, packet []byte) error {
-	_, err := conn.Write(packet)
-	return err
+/** Accept the changed key of owner and send what was waiting for it. **/
+func trustKey(c *client.Client, nickname string, owner string) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
+
+	key, ok := pending.changed[owner]
+	if !ok {
+		fmt.Printf("[No changed key for %s.]\n\n", owner)
+		return
+	}
+
+	if err := knownKeys.Trust(owner, key); err != nil {
+		fmt.Println("Error saving known keys:", err)
+		return
+	}
+	delete(pending.changed, owner)
+	fmt.Printf("[Now trusting %s with key %s.]\n\n", owner, key.Fingerprint())
+
+	flushSecrets(c, nickname, owner, key)
 }
 
-/** Return response, rtt and error */
-func receiveRes(conn net.Conn) []Response {
-	buffer := make([]byte, 1024)
+/** Send the secrets held for owner, who has no key, without encryption. **/
+func sendUnencrypted(c *client.Client, nickname string, owner string) {
+	pending.mu.Lock()
+	defer pending.mu.Unlock()
 
-	n, _ := conn.Read(buffer)
+	messages, ok := pending.unencrypted[owner]
+	if !ok {
+		fmt.Printf("[No unencrypted secrets waiting for %s.]\n\n", owner)
+		return
+	}
+	delete(pending.unencrypted, owner)
+
+	for _, message := range messages {
+		sendReq(c, protocol.NewRequest(protocol.ReqSecret, nickname, owner, message))
+	}
+	fmt.Printf("[Sent %d message(s) to %s in plaintext.]\n\n", len(messages), owner)
+}
 
-	var responses []Response
-	decoder := json.NewDecoder(bytes.NewReader(buffer[:n]))
-	for decoder.More() {
-		var response Response
-		if err := decoder.Decode(&response); err != nil {
-			fmt.Println("Error decoding:", err)
+/** Caller must hold pending.mu. Seal queued messages to owner and open queued messages from owner. **/
+func flushSecrets(c *client.Client, nickname string, owner string, key e2e.PublicKey) {
+	for _, message := range pending.outgoing[owner] {
+		sealed, err := e2e.Seal(identity, nickname, key, owner, message)
+		if err != nil {
+			fmt.Println("Error encrypting message:", err)
 			continue
 		}
-		responses = append(responses, response)
+
+		request := protocol.NewRequest(protocol.ReqSecret, nickname, owner, sealed)
+		request.Body.Encrypted = true
+		sendReq(c, request)
 	}
-	return responses
+
+	for _, response := range pending.incoming[owner] {
+		text, err := e2e.Open(identity, nickname, key, owner, response.Message)
+		if err != nil {
+			fmt.Printf("[Could not read encrypted message from %s: %v]\n\n", owner, err)
+			continue
+		}
+		showMessage(tui.Secret, fmt.Sprintf("#%d from: %s> %s [encrypted]", response.ID, owner, text))
+		markRead(c, nickname, response)
+	}
+
+	delete(pending.outgoing, owner)
+	delete(pending.incoming, owner)
 }
 
-/** Disconnect and exit program */
-func exit(conn net.Conn, request []byte) {
-	_ = sendReq(conn, request)
+/* File transfers *
+ * uploads: files we offered, by hash, until the server says where to upload them
+ * offers: files offered to us, by ID, until we \accept or \decline them */
+var transferMu sync.Mutex
+var uploads = make(map[string]string)
+var offers = make(map[string]protocol.Response)
+
+/** Offer the file at path to receiver, or to the room if receiver is "all". **/
+func offerFile(c *client.Client, nickname string, receiver string, path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		fmt.Printf("[cannot send %s: %v]\n\n", path, err)
+		return
+	} else if !info.Mode().IsRegular() {
+		fmt.Printf("[cannot send %s: not a regular file]\n\n", path)
+		return
+	}
+
+	hash, size, err := filetransfer.Hash(path)
+	if err != nil {
+		fmt.Printf("[cannot send %s: %v]\n\n", path, err)
+		return
+	}
+
+	transferMu.Lock()
+	uploads[hash] = path
+	transferMu.Unlock()
 
-	conn.Close()
+	request := protocol.NewRequest(protocol.ReqOffer, nickname, receiver, "")
+	request.Body.File = &protocol.FileInfo{Name: filepath.Base(path), Size: size, Hash: hash}
+	sendReq(c, request)
+}
+
+/** Upload a file the server took the offer of, in the background. **/
+func startUpload(nickname string, response protocol.Response) {
+	if response.File == nil {
+		return
+	}
+	info := *response.File
+
+	transferMu.Lock()
+	path, ok := uploads[info.Hash]
+	delete(uploads, info.Hash)
+	transferMu.Unlock()
+	if !ok {
+		return
+	}
+
+	go func() {
+		if err := upload(nickname, path, info, response.DataPort); err != nil {
+			fmt.Printf("[upload of %s failed: %v]\n\n", info.Name, err)
+		}
+	}()
+}
+
+/** Stream the file at path to the server over a data connection. **/
+func upload(nickname string, path string, info protocol.FileInfo, port string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	conn, err := dial(serverName, port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	request := protocol.NewRequest(protocol.ReqUpload, nickname, "", "")
+	request.Body.File = &info
+	if err := protocol.WriteRequest(conn, request); err != nil {
+		return err
+	}
+	if err := filetransfer.Copy(conn, file, info.Size, info.Hash, showProgress("sending "+info.Name)); err != nil {
+		return err
+	}
+
+	response, err := protocol.ReadResponse(conn)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n\n", response.Message)
+	return nil
+}
+
+/** Remember a file offered to us and ask what to do with it. **/
+func receivedOffer(response protocol.Response) {
+	if response.File == nil {
+		return
+	}
+	info := response.File
+
+	transferMu.Lock()
+	offers[info.ID] = response
+	transferMu.Unlock()
+
+	fmt.Printf("[%s wants to send you %s (%s). \\accept %s to save it or \\decline %s.]\n\n",
+		response.Sender, info.Name, filetransfer.FormatSize(info.Size), info.ID, info.ID)
+}
+
+/** Download offered file id into downloadsDir in the background. **/
+func acceptFile(nickname string, id string) {
+	transferMu.Lock()
+	offer, ok := offers[id]
+	delete(offers, id)
+	transferMu.Unlock()
+	if !ok {
+		fmt.Printf("[no such file offer: %s]\n\n", id)
+		return
+	}
+
+	go func() {
+		path, err := download(nickname, *offer.File, offer.DataPort)
+		if err != nil {
+			fmt.Printf("[download of %s failed: %v]\n\n", offer.File.Name, err)
+		} else {
+			fmt.Printf("[saved %s from %s to %s]\n\n", offer.File.Name, offer.Sender, path)
+		}
+	}()
+}
+
+/** Fetch a file over a data connection, check its hash and save it. Returns where it was saved. **/
+func download(nickname string, info protocol.FileInfo, port string) (string, error) {
+	conn, err := dial(serverName, port)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	request := protocol.NewRequest(protocol.ReqDownload, nickname, "", "")
+	request.Body.File = &info
+	if err := protocol.WriteRequest(conn, request); err != nil {
+		return "", err
+	}
+	response, err := protocol.ReadResponse(conn)
+	if err != nil {
+		return "", err
+	} else if response.Code == protocol.ResError {
+		return "", errors.New(response.Message)
+	}
+
+	if err := os.MkdirAll(downloadsDir, 0755); err != nil {
+		return "", err
+	}
+	part, err := os.CreateTemp(downloadsDir, ".part-*")
+	if err != nil {
+		return "", err
+	}
+	part.Chmod(0644)
+	err = filetransfer.Copy(part, conn, info.Size, info.Hash, showProgress("receiving "+info.Name))
+	part.Close()
+	if err != nil {
+		os.Remove(part.Name())
+		return "", err
+	}
+
+	path := filetransfer.FreePath(downloadsDir, filetransfer.CleanName(info.Name))
+	if err := os.Rename(part.Name(), path); err != nil {
+		os.Remove(part.Name())
+		return "", err
+	}
+	return path, nil
+}
+
+/** Refuse offered file id. **/
+func declineFile(c *client.Client, nickname string, id string) {
+	transferMu.Lock()
+	_, ok := offers[id]
+	delete(offers, id)
+	transferMu.Unlock()
+	if !ok {
+		fmt.Printf("[no such file offer: %s]\n\n", id)
+		return
+	}
+
+	request := protocol.NewRequest(protocol.ReqDecline, nickname, id, "")
+	sendReq(c, request)
+}
+
+/** Return a progress callback that keeps one line updated with how far label has got. **/
+func showProgress(label string) filetransfer.Progress {
+	last := int64(-1)
+	return func(done int64, total int64) {
+		percent := done * 100 / total
+		if percent == last {
+			return
+		}
+		last = percent
+
+		fmt.Printf("\r[%s: %3d%% of %s]", label, percent, filetransfer.FormatSize(total))
+		if done == total {
+			fmt.Printf("\n")
+		}
+	}
+}
+
+/* Keyboard input *
+ * On a terminal the client reads key by key and echoes them itself, so it can
+ * say we're typing before Enter is pressed. Otherwise it reads whole lines.
+ * With -tui the screen does both, and everything printed goes to its message pane. */
+const typingInterval = 3 * time.Second
+
+var stdin = bufio.NewReader(os.Stdin)
+var rawInput = false
+
+/** Switch a terminal on stdin to key-at-a-time input without echo, or to full-screen mode with -tui. **/
+func setupTerminal(nickname string) {
+	if useTUI {
+		s, err := tui.Open(fmt.Sprintf("%s @ %s:%s", nickname, serverName, serverPort))
+		if err == nil {
+			screen = s
+			return
+		}
+		fmt.Printf("[Cannot start full-screen mode: %v. using plain lines.]\n\n", err)
+	}
+
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return
+	}
+	rawInput = stty("-icanon", "-echo", "min", "1") == nil
+}
+
+/** Give the terminal back its line editing. **/
+func restoreTerminal() {
+	if screen != nil {
+		screen.Close()
+	} else if rawInput {
+		stty("icanon", "echo")
+	}
+}
+
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
+
+/** Restore the terminal and exit. **/
+func terminate(code int) {
+	restoreTerminal()
+	os.Exit(code)
+}
+
+/** Read a line of input. While it is typed, typing is called with the line so far every typingInterval until it reports sending a notice. **/
+func readLine(typing func(line string) bool) (string, error) {
+	if screen != nil {
+		return screen.ReadLine(typing, typingInterval)
+	} else if !rawInput {
+		return stdin.ReadString('\n')
+	}
+
+	var line []byte
+	var noticed time.Time
+	for {
+		b, err := stdin.ReadByte()
+		if err != nil {
+			return string(line), err
+		}
+
+		if b == '\r' || b == '\n' {
+			fmt.Print("\n")
+			return string(line), nil
+		} else if b == 0x7f || b == '\b' { // backspace
+			if len(line) > 0 {
+				_, size := utf8.DecodeLastRune(line)
+				line = line[:len(line)-size]
+				fmt.Print("\b \b")
+			}
+		} else if b == 0x15 { // Ctrl-U
+			fmt.Print(strings.Repeat("\b \b", utf8.RuneCount(line)))
+			line = line[:0]
+		} else if b == 0x1b { // arrow keys and the like are ignored
+			if next, _ := stdin.ReadByte(); next == '[' {
+				for {
+					c, err := stdin.ReadByte()
+					if err != nil || (c >= 0x40 && c <= 0x7e) {
+						break
+					}
+				}
+			}
+		} else if b >= 0x20 {
+			line = append(line, b)
+			os.Stdout.Write([]byte{b})
+			if time.Since(noticed) > typingInterval && typing(string(line)) {
+				noticed = time.Now()
+			}
+		}
+	}
+}
+
+/** Show a message from the server, coloured by kind in full-screen mode. **/
+func showMessage(kind tui.Kind, text string) {
+	if screen != nil {
+		screen.Print(kind, text)
+	} else {
+		fmt.Printf("%s\n\n", text)
+	}
+}
+
+/** Keep the sidebar's user list fresh with quiet \ls requests. **/
+func refreshUsers(c *client.Client, nickname string) {
+	for {
+		// Not through sendReq: a refresh missed while reconnecting isn't worth a message.
+		quietLists.Add(1)
+		if c.Send(protocol.NewRequest(protocol.ReqList, nickname, "", "")) != nil {
+			quietLists.Add(-1)
+		}
+		time.Sleep(usersRefresh)
+	}
+}
+
+/** Send request to server and return error */
+func sendReq(c *client.Client, request protocol.Request) error {
+	err := c.Send(request)
+	if err == protocol.ErrFrameTooLarge {
+		fmt.Printf("Message too long. (limit is %d bytes)\n\n", protocol.MaxFrameSize)
+	} else if err != nil {
+		fmt.Printf("[Not connected. message not sent.]\n\n")
+	}
+	return err
+}
+
+/** Disconnect and exit program */
+func exit(c *client.Client) {
+	c.Close()
 	fmt.Println("gg~")
-	os.Exit(0)
+	terminate(0)
+}
+
+/** Bot mode: pass JSON requests from stdin to the server and print its responses to stdout. Returns the exit code. **/
+func runJSON(nickname string) int {
+	config, err := clientConfig(nickname)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error connecting to server:", err)
+		return 1
+	}
+
+	c, welcome, err := client.Dial(config)
+	out := json.NewEncoder(os.Stdout)
+	if welcome.Message != "" {
+		out.Encode(welcome)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error connecting to server:", err)
+		return 1
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		c.Close()
+	}()
+
+	// One request per line, like {"header":{"code":1},"body":{"message":"hi"}}. Leaves when stdin ends.
+	go func() {
+		for {
+			line, err := stdin.ReadBytes('\n')
+			if len(strings.TrimSpace(string(line))) > 0 {
+				var request protocol.Request
+				if jerr := json.Unmarshal(line, &request); jerr != nil {
+					fmt.Fprintln(os.Stderr, "Invalid request:", jerr)
+				} else if request.Header.Code == protocol.ReqQuit {
+					break
+				} else if serr := c.Send(request); serr != nil {
+					fmt.Fprintln(os.Stderr, "Request not sent:", serr)
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		c.Close()
+	}()
+
+	err = c.Handle(func(response protocol.Response) {
+		out.Encode(response)
+	})
+	if err != nil && !errors.Is(err, client.ErrClosed) {
+		fmt.Fprintln(os.Stderr, "Disconnected from server:", err)
+		return 1
+	}
+	return 0
 }
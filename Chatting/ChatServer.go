@@ -5,297 +5,2983 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"math"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/young-jin-son/Network-Practice/Chatting/accounts"
+	"github.com/young-jin-son/Network-Practice/Chatting/filetransfer"
+	"github.com/young-jin-son/Network-Practice/Chatting/history"
+	"github.com/young-jin-son/Network-Practice/Chatting/irc"
+	"github.com/young-jin-son/Network-Practice/Chatting/metrics"
+	"github.com/young-jin-son/Network-Practice/Chatting/moderation"
+	"github.com/young-jin-son/Network-Practice/Chatting/protocol"
+	"github.com/young-jin-son/Network-Practice/Chatting/registry"
+	"github.com/young-jin-son/Network-Practice/Chatting/tlsutil"
+	"github.com/young-jin-son/Network-Practice/Chatting/webchat"
+	"github.com/young-jin-son/Network-Practice/config"
+)
+
+type Client struct {
+	ID       int
+	Nickname string
+	Conn     net.Conn
+	Operator bool
+
+	// Published for end-to-end encrypted secrets; empty for clients without one.
+	PublicKey string
+
+	// Token the client can resume with if its connection drops.
+	Session string
+
+	// Who may change the client's messages later: "account:<nickname>" once the nickname is proven
+	// by a password or certificate, otherwise "session:<id>" for as long as the session lasts.
+	Author string
+
+	// Outbound queue drained by writeLoop.
+	mu      sync.Mutex
+	wake    *sync.Cond
+	pending [][]byte
+	closing bool
+	done    chan struct{}
+}
+
+/* Overflow Policy *
+ * drop: discard the oldest queued message
+ * disconnect: send Code 3 and close the connection */
+const (
+	overflowDrop       = "drop"
+	overflowDisconnect = "disconnect"
 )
 
-/* Request Code *
- * 0: make new connection
- * 1: default (send to all)
- * 2: "\ls" command
- * 3: "\secret" command
- * 4: "\except" command
- * 5: "\ping" command
- * 6: "\quit" command */
-type Request struct {
-	Header struct {
-		Code     byte   `json:"code"`
-		Sender   string `json:"sender"`
-		Receiver string `json:"receiver"`
-	} `json:"header"`
-	Body struct {
-		Message string `json:"message"`
-	} `json:"body"`
-}
-
-/* Response Code *
- * 0: for RTT
- * 1: response for my request
- * 2: message from other clients
- * 3: something bad
- * 4: server terminated */
-type Response struct {
-	Code    byte   `json:"code"`
-	Message string `json:"message"`
+var serverPort = "30768"
+
+// Browsers load the web client from this port and join over a WebSocket on it.
+var webPort = ""
+
+// Pages from other sites may only join if their origin is listed here.
+var webOrigins = ""
+
+// IRC clients join on this port; channels are rooms.
+var ircPort = ""
+
+var queueSize = 64
+var overflowPolicy = overflowDrop
+var writeTimeout = 5 * time.Second
+var shutdownTimeout = 5 * time.Second
+
+/* Dead connections *
+ * heartbeatInterval: how often the server pings each client
+ * idleTimeout: a client that sends nothing, not even a heartbeat reply, for this long is evicted
+ * readTimeout: how long a new connection may take to send its connect request */
+var heartbeatInterval = 30 * time.Second
+var idleTimeout = 90 * time.Second
+var readTimeout = 10 * time.Second
+
+/* Metrics, served in the Prometheus text format at /metrics on metricsPort */
+var metricsPort = ""
+
+var connectedClients = metrics.NewGaugeFunc("chat_clients", "Users connected to the server.", func() float64 { return float64(clients.Len()) })
+var requestsTotal = metrics.NewCounterVec("chat_requests_total", "Requests read from clients, by request code.", "code")
+var receivedBytes = metrics.NewCounter("chat_received_bytes_total", "Bytes of frames read from chat connections.")
+var sentBytes = metrics.NewCounter("chat_sent_bytes_total", "Bytes of frames written to chat connections.")
+var fanoutSeconds = metrics.NewHistogram("chat_fanout_seconds", "Time to queue one message for everyone in a room or on the server.",
+	[]float64{0.00001, 0.00005, 0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1})
+var kicksTotal = metrics.NewCounterVec("chat_kicks_total", "Users kicked or banned while connected, by operator or moderation.", "by")
+var rejectedConns = metrics.NewCounterVec("chat_rejected_connections_total", "Connections turned away before joining, by reason.", "reason")
+var writeErrors = metrics.NewCounter("chat_write_errors_total", "Failed writes to chat connections.")
+
+func newClient(id int, nickname string, conn net.Conn) *Client {
+	client := &Client{ID: id, Nickname: nickname, Conn: conn, done: make(chan struct{})}
+	client.wake = sync.NewCond(&client.mu)
+	return client
+}
+
+/** Queue an encoded response for the client without blocking the caller. **/
+func (c *Client) Send(msg []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return
+	}
+
+	if len(c.pending) >= queueSize {
+		if overflowPolicy == overflowDisconnect {
+			kick, _ := protocol.EncodeResponse(protocol.NewResponse(protocol.ResError, "[You are disconnected for falling too far behind.]"))
+			c.pending = [][]byte{kick}
+			c.closing = true
+			c.wake.Signal()
+			return
+		}
+		c.pending = c.pending[1:]
+	}
+
+	c.pending = append(c.pending, msg)
+	c.wake.Signal()
+}
+
+/** Queue a response for the client. **/
+func (c *Client) Reply(response protocol.Response) {
+	msg, _ := protocol.EncodeResponse(response)
+	c.Send(msg)
+}
+
+/** Stop accepting messages and close the connection once the queue has been flushed. **/
+func (c *Client) Close() {
+	c.mu.Lock()
+	c.closing = true
+	c.wake.Signal()
+	c.mu.Unlock()
+}
+
+/** Write queued messages in order until the client is closed or a write fails. **/
+func (c *Client) writeLoop() {
+	defer close(c.done)
+	defer c.Conn.Close()
+
+	for {
+		c.mu.Lock()
+		for len(c.pending) == 0 && !c.closing {
+			c.wake.Wait()
+		}
+		if len(c.pending) == 0 {
+			c.mu.Unlock()
+			return
+		}
+		msg := c.pending[0]
+		c.pending = c.pending[1:]
+		c.mu.Unlock()
+
+		c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		if err := protocol.WriteFrame(c.Conn, msg); err == protocol.ErrFrameTooLarge {
+			// Nothing was written, so the connection is fine; only this message is lost.
+			fmt.Printf("Error sending message to %s: %d bytes is over the frame limit.\n", c.Nickname, len(msg))
+			writeErrors.Inc()
+			continue
+		} else if err != nil {
+			fmt.Println("Error sending message to client:", err)
+			writeErrors.Inc()
+
+			c.mu.Lock()
+			c.closing = true
+			c.pending = nil
+			c.mu.Unlock()
+			return
+		}
+		sentBytes.Add(float64(protocol.FrameHeaderSize + len(msg)))
+	}
+}
+
+/** Ping the client every heartbeatInterval until its connection is done. **/
+func (c *Client) heartbeat() {
+	if heartbeatInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Reply(protocol.NewResponse(protocol.ResRTT, protocol.Heartbeat))
+		case <-c.done:
+			return
+		}
+	}
+}
+
+var errRoomFull = errors.New("room full")
+
+var maxClients = 64
+
+var clients = registry.New[*Client]()
+
+type Room struct {
+	Name    string
+	Limit   int
+	members map[int]*Client
+}
+
+/** Named chat rooms and which room each client is in, safe for concurrent use. **/
+type Rooms struct {
+	mu     sync.RWMutex
+	byName map[string]*Room
+	of     map[int]*Room
+}
+
+var errRoomExists = errors.New("room already exists")
+var errNoSuchRoom = errors.New("no such room")
+var errAlreadyInRoom = errors.New("already in room")
+
+/* Every client starts in the lobby, which is never removed. */
+const lobby = "lobby"
+
+var roomLimit = 8
+
+var rooms = newRooms()
+
+var historyPath = "chat_history.log"
+var replayCount = 10
+var historyPageSize = 20
+
+var chatLog *history.Log
+
+type offlineMessage struct {
+	ID        uint64    `json:"id"`
+	Sender    string    `json:"sender"`
+	Message   string    `json:"message"`
+	Sent      time.Time `json:"sent"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+}
+
+/** Secret messages held for nicknames that are not connected, safe for concurrent use. **/
+type Mailbox struct {
+	mu      sync.Mutex
+	path    string // saved here after every change, unless empty
+	seen    map[string]bool
+	pending map[string][]offlineMessage
+}
+
+/* Mailbox file *
+ * {"seen": ["alice", "bob"], "pending": {"bob": [{"id": 7, "sender": "alice", ...}]}} */
+type mailboxFile struct {
+	Seen    []string                    `json:"seen"`
+	Pending map[string][]offlineMessage `json:"pending"`
+}
+
+var mailboxPath = "mailbox.json"
+
+var errUnknownNickname = errors.New("nickname never seen")
+var errMailboxFull = errors.New("mailbox full")
+
+/** Public keys published by clients for end-to-end encrypted secrets, kept after they leave. **/
+type KeyDirectory struct {
+	mu   sync.RWMutex
+	keys map[string]string
+}
+
+var publicKeys = &KeyDirectory{keys: make(map[string]string)}
+
+/** Record the key nickname joined with. An empty key removes the old one. **/
+func (d *KeyDirectory) Publish(nickname string, key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if key == "" {
+		delete(d.keys, nickname)
+	} else {
+		d.keys[nickname] = key
+	}
+}
+
+/** Return the key nickname last published, or "". **/
+func (d *KeyDirectory) Lookup(nickname string) string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.keys[nickname]
+}
+
+var offlineTTL = 24 * time.Hour
+var offlineCap = 20
+
+var mailbox = newMailbox()
+
+// Last chat message ID handed out; continues from the history log on start.
+var lastMessageID atomic.Uint64
+
+/** Secrets delivered but not yet read, so read receipts can only come from their receiver. **/
+type Receipts struct {
+	mu     sync.Mutex
+	unread map[uint64]unreadSecret
+}
+
+type unreadSecret struct {
+	Sender    string
+	Receiver  string
+	Delivered time.Time
+}
+
+var receipts = &Receipts{unread: make(map[uint64]unreadSecret)}
+
+/** Remember that secret id from sender reached receiver. **/
+func (r *Receipts) Track(id uint64, sender string, receiver string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for old, secret := range r.unread {
+		if time.Since(secret.Delivered) > offlineTTL {
+			delete(r.unread, old)
+		}
+	}
+	r.unread[id] = unreadSecret{Sender: sender, Receiver: receiver, Delivered: time.Now()}
+}
+
+/** Forget secret id once reader has read it and return who sent it. **/
+func (r *Receipts) Read(id uint64, reader string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	secret, ok := r.unread[id]
+	if !ok || secret.Receiver != reader {
+		return "", false
+	}
+	delete(r.unread, id)
+	return secret.Sender, true
+}
+
+/** Recent chat messages by ID, so they can be edited, deleted and reacted to. **/
+type Messages struct {
+	mu     sync.Mutex
+	byID   map[uint64]*history.Entry
+	seenBy map[uint64][]string // nicknames each message went to, unknown for messages from before a restart
+	order  []uint64
+}
+
+var errNoSuchMessage = errors.New("no such message")
+
+// Only this many of the newest messages can be changed.
+var editableCount = 1000
+
+// Longest reaction accepted, in characters.
+const reactionLimit = 8
+
+var messages = &Messages{byID: make(map[uint64]*history.Entry), seenBy: make(map[uint64][]string)}
+
+/* File transfers *
+ * Files are uploaded to spoolDir over a data connection on dataPort, then offered to their receivers,
+ * who download them over a data connection of their own. */
+var dataPort = "30769"
+var maxFileSize int64 = 10 << 20
+var fileTTL = 10 * time.Minute
+var spoolDir = ""
+
+type transfer struct {
+	Info      protocol.FileInfo // Token is the sender's upload token
+	Sender    string
+	Receivers map[string]string // yet to accept or decline, with the token each one downloads with
+	Path      string            // spooled copy, once uploaded
+	Uploading bool              // a data connection is carrying the upload
+	Ready     bool
+	Created   time.Time
+}
+
+/** Files offered and not yet taken by all their receivers, safe for concurrent use. **/
+type Transfers struct {
+	mu     sync.Mutex
+	byID   map[string]*transfer
+	lastID int
+}
+
+var errNoSuchTransfer = errors.New("no such transfer")
+
+var transfers = &Transfers{byID: make(map[string]*transfer)}
+
+/** Named lists of nicknames each user keeps for use as targets, safe for concurrent use. **/
+type Groups struct {
+	mu      sync.Mutex
+	byOwner map[string]map[string][]string
+}
+
+var errGroupExists = errors.New("group already exists")
+var errNoSuchGroup = errors.New("no such group")
+var errTooManyGroups = errors.New("too many groups")
+var errGroupFull = errors.New("group full")
+
+var groupLimit = 32
+var groupSize = 64
+
+var groups = &Groups{byOwner: make(map[string]map[string][]string)}
+
+/** A client's place on the server, kept for a while after its connection drops. **/
+type session struct {
+	Nickname string
+	Operator bool
+	Author   string
+	ClientID int       // connection currently holding the session
+	Room     string    // room it was in when it dropped
+	Left     time.Time // zero while connected
+	Missed   []history.Entry
+}
+
+/** Sessions by token, safe for concurrent use. **/
+type Sessions struct {
+	mu      sync.Mutex
+	byToken map[string]*session
+}
+
+var resumeWindow = 2 * time.Minute
+var resumeBuffer = 100
+
+var sessions = &Sessions{byToken: make(map[string]*session)}
+
+/* Operator config file *
+ * {"nicknames": ["prof"], "password": "..."} */
+type OperatorConfig struct {
+	Nicknames []string `json:"nicknames"`
+	Password  string   `json:"password"`
+}
+
+var operatorsPath = ""
+var operators OperatorConfig
+
+var accountsPath = "accounts.json"
+var accountStore *accounts.Store
+var loginThrottle = accounts.NewThrottle()
+
+/* TLS is on when a certificate is given or generated. */
+var certFile = ""
+var keyFile = ""
+var selfSigned = false
+var clientCAFile = ""
+
+var moderationPath = ""
+var moderator *moderation.Pipeline
+var sanctions = moderation.NewSanctions()
+
+func newRooms() *Rooms {
+	r := &Rooms{byName: make(map[string]*Room), of: make(map[int]*Room)}
+	r.byName[lobby] = &Room{Name: lobby, members: make(map[int]*Client)}
+	return r
+}
+
+/** Create an empty room. A limit of 0 uses the default room limit. **/
+func (r *Rooms) Create(name string, limit int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.byName[name]; ok {
+		return errRoomExists
+	}
+	r.byName[name] = &Room{Name: name, Limit: limit, members: make(map[int]*Client)}
+	return nil
+}
+
+/** Move client into room, leaving its current room, and return the room's new size. **/
+func (r *Rooms) Join(client *Client, name string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	room, ok := r.byName[name]
+	if !ok {
+		return 0, errNoSuchRoom
+	}
+	if r.of[client.ID] == room {
+		return len(room.members), errAlreadyInRoom
+	}
+	if len(room.members) >= room.limit() {
+		return len(room.members), errRoomFull
+	}
+
+	r.leave(client)
+	room.members[client.ID] = client
+	r.of[client.ID] = room
+	return len(room.members), nil
+}
+
+/** Take client out of its room and return the room's name and remaining size. **/
+func (r *Rooms) Remove(client *Client) (string, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	room := r.leave(client)
+	if room == nil {
+		return "", 0
+	}
+	return room.Name, len(room.members)
+}
+
+/** Caller must hold r.mu. Empty rooms other than the lobby are deleted. **/
+func (r *Rooms) leave(client *Client) *Room {
+	room, ok := r.of[client.ID]
+	if !ok {
+		return nil
+	}
+
+	delete(room.members, client.ID)
+	delete(r.of, client.ID)
+	if len(room.members) == 0 && room.Name != lobby {
+		delete(r.byName, room.Name)
+	}
+	return room
+}
+
+/** Return the name of the room client is in. **/
+func (r *Rooms) Of(client *Client) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if room, ok := r.of[client.ID]; ok {
+		return room.Name
+	}
+	return ""
+}
+
+/** Return the members of room ordered by join. **/
+func (r *Rooms) Members(name string) []*Client {
+	r.mu.RLock()
+	room, ok := r.byName[name]
+	if !ok {
+		r.mu.RUnlock()
+		return nil
+	}
+	members := make([]*Client, 0, len(room.members))
+	for _, client := range room.members {
+		members = append(members, client)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+/** Return room names in alphabetical order with the lobby first. **/
+func (r *Rooms) Names() []string {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.byName))
+	for name := range r.byName {
+		if name != lobby {
+			names = append(names, name)
+		}
+	}
+	r.mu.RUnlock()
+
+	sort.Strings(names)
+	return append([]string{lobby}, names...)
+}
+
+/** Return "name (members/limit)" for room, or "" if it is gone. **/
+func (r *Rooms) Describe(name string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	room, ok := r.byName[name]
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s (%d/%d)", room.Name, len(room.members), room.limit())
+}
+
+/** Change the capacity of a room. Members over the new limit stay. **/
+func (r *Rooms) SetLimit(name string, limit int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	room, ok := r.byName[name]
+	if !ok {
+		return errNoSuchRoom
+	}
+	room.Limit = limit
+	return nil
+}
+
+func (room *Room) limit() int {
+	if room.Limit > 0 {
+		return room.Limit
+	}
+	return roomLimit
+}
+
+func newMailbox() *Mailbox {
+	return &Mailbox{seen: make(map[string]bool), pending: make(map[string][]offlineMessage)}
+}
+
+/** Open the mailbox file at path, so held messages and who has been seen survive a restart. A missing file is an empty mailbox. **/
+func openMailbox(path string) (*Mailbox, error) {
+	m := newMailbox()
+	m.path = path
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var file mailboxFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	for _, nickname := range file.Seen {
+		m.seen[nickname] = true
+	}
+	for receiver, queued := range file.Pending {
+		m.pending[receiver] = queued
+	}
+	return m, nil
+}
+
+/** Caller must hold m.mu. Save the mailbox if it has a file. **/
+func (m *Mailbox) save() {
+	if m.path == "" {
+		return
+	}
+	if err := m.write(); err != nil {
+		fmt.Println("Error saving mailbox:", err)
+	}
+}
+
+/** Caller must hold m.mu. Write the file through a temporary so a crash can't truncate it. **/
+func (m *Mailbox) write() error {
+	file := mailboxFile{Pending: m.pending}
+	for nickname := range m.seen {
+		file.Seen = append(file.Seen, nickname)
+	}
+	sort.Strings(file.Seen)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(m.path), filepath.Base(m.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
+
+/** Remember that nickname has been connected, so messages can be held for it. **/
+func (m *Mailbox) Seen(nickname string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.seen[nickname] {
+		m.seen[nickname] = true
+		m.save()
+	}
+}
+
+/** Hold a message for receiver until it reconnects. **/
+func (m *Mailbox) Hold(receiver string, msg offlineMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.seen[receiver] {
+		return errUnknownNickname
+	}
+
+	queued := m.expire(receiver)
+	if len(queued) >= offlineCap {
+		return errMailboxFull
+	}
+	m.pending[receiver] = append(queued, msg)
+	m.save()
+	return nil
+}
+
+/** Remove and return unexpired messages held for receiver. **/
+func (m *Mailbox) Take(receiver string) []offlineMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queued := m.expire(receiver)
+	delete(m.pending, receiver)
+	if len(queued) > 0 {
+		m.save()
+	}
+	return queued
+}
+
+/** Replace the text of held message id, or drop it if text is "". Returns whether it was still held. **/
+func (m *Mailbox) Revise(receiver string, id uint64, text string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	queued := m.pending[receiver]
+	for i := range queued {
+		if queued[i].ID != id {
+			continue
+		}
+		if text == "" {
+			m.pending[receiver] = append(queued[:i:i], queued[i+1:]...)
+		} else {
+			queued[i].Message = text
+		}
+		m.save()
+		return true
+	}
+	return false
+}
+
+/** Caller must hold m.mu. Drop expired messages for receiver and return the rest. **/
+func (m *Mailbox) expire(receiver string) []offlineMessage {
+	queued := m.pending[receiver]
+	for len(queued) > 0 && time.Since(queued[0].Sent) > offlineTTL {
+		queued = queued[1:]
+	}
+	if len(queued) == 0 {
+		delete(m.pending, receiver)
+		return nil
+	}
+	m.pending[receiver] = queued
+	return queued
+}
+
+/** Open a session for a client that just joined and return its token. **/
+func (s *Sessions) Start(client *Client) string {
+	token := newToken()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A nickname has one session; a new user with it ends the old one.
+	for old, sess := range s.byToken {
+		if sess.Nickname == client.Nickname {
+			delete(s.byToken, old)
+		}
+	}
+	s.byToken[token] = &session{Nickname: client.Nickname, Operator: client.Operator, Author: client.Author, ClientID: client.ID}
+	return token
+}
+
+/** Return the session token names if nickname may resume it. **/
+func (s *Sessions) Lookup(token string, nickname string) (session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	sess, ok := s.byToken[token]
+	if !ok || sess.Nickname != nickname {
+		return session{}, false
+	}
+	return *sess, true
+}
+
+/** Hand the session over to client and return what it missed. **/
+func (s *Sessions) Attach(token string, client *Client) ([]history.Entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.byToken[token]
+	if !ok || sess.Nickname != client.Nickname {
+		return nil, false
+	}
+	missed := sess.Missed
+	sess.ClientID = client.ID
+	sess.Left = time.Time{}
+	sess.Missed = nil
+	return missed, true
+}
+
+/** Keep the session of a dropped connection so it can be resumed from room. **/
+func (s *Sessions) Away(token string, clientID int, room string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.byToken[token]; ok && sess.ClientID == clientID {
+		sess.Left = time.Now()
+		sess.Room = room
+	}
+}
+
+/** Forget the session of a client that quit or was removed. **/
+func (s *Sessions) End(token string, clientID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.byToken[token]; ok && sess.ClientID == clientID {
+		delete(s.byToken, token)
+	}
+}
+
+/** Keep entry for sessions that are away and would have seen it. **/
+func (s *Sessions) Missed(entry history.Entry, seenBy []string) []string {
+	if entry.Kind == history.KindSecret { // the mailbox holds those
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	var queued []string
+	for _, sess := range s.byToken {
+		if !sess.Left.IsZero() && reaches(entry, seenBy, sess.Room, sess.Nickname) {
+			if len(sess.Missed) >= resumeBuffer {
+				sess.Missed = sess.Missed[1:]
+			}
+			sess.Missed = append(sess.Missed, entry)
+			queued = append(queued, sess.Nickname)
+		}
+	}
+	return queued
+}
+
+/** Keep track of a recorded chat message and the nicknames it went to, or apply a recorded change to one. **/
+func (m *Messages) Apply(entry history.Entry, seenBy []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if entry.Action == "" {
+		m.byID[entry.ID] = &entry
+		if seenBy != nil {
+			m.seenBy[entry.ID] = seenBy
+		}
+		m.order = append(m.order, entry.ID)
+		for len(m.order) > editableCount {
+			delete(m.byID, m.order[0])
+			delete(m.seenBy, m.order[0])
+			m.order = m.order[1:]
+		}
+		return
+	}
+
+	msg, ok := m.byID[entry.ID]
+	if !ok {
+		return
+	}
+	if entry.Action == history.ActionEdit {
+		msg.Message = entry.Message
+	} else if entry.Action == history.ActionDelete {
+		delete(m.byID, entry.ID)
+		delete(m.seenBy, entry.ID)
+	}
+}
+
+/** Return message id as it is now. **/
+func (m *Messages) Get(id uint64) (history.Entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	msg, ok := m.byID[id]
+	if !ok {
+		return history.Entry{}, errNoSuchMessage
+	}
+	return *msg, nil
+}
+
+/** Return the nicknames message id went to, or nil if that is not known. **/
+func (m *Messages) SeenBy(id uint64) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.seenBy[id]
+}
+
+/** Register a file sender wants to give receivers and return it with its ID and upload token. **/
+func (t *Transfers) Offer(sender string, info protocol.FileInfo, receivers []string) protocol.FileInfo {
+	info.Token = newToken()
+	waiting := make(map[string]string)
+	for _, nickname := range receivers {
+		waiting[nickname] = newToken()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire()
+	t.lastID++
+	info.ID = strconv.Itoa(t.lastID)
+	t.byID[info.ID] = &transfer{Info: info, Sender: sender, Receivers: waiting, Created: time.Now()}
+	return info
+}
+
+/** Claim the upload of the transfer info names if its upload token matches, so no other connection can carry it. **/
+func (t *Transfers) StartUpload(info protocol.FileInfo) (transfer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire()
+	found, ok := t.byID[info.ID]
+	if !ok || found.Uploading || found.Ready || subtle.ConstantTimeCompare([]byte(found.Info.Token), []byte(info.Token)) != 1 {
+		return transfer{}, errNoSuchTransfer
+	}
+	found.Uploading = true
+	return *found, nil
+}
+
+/** Return the uploaded transfer info names and the receiver whose download token it carries. **/
+func (t *Transfers) StartDownload(info protocol.FileInfo) (transfer, string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.expire()
+	found, ok := t.byID[info.ID]
+	if !ok || !found.Ready {
+		return transfer{}, "", errNoSuchTransfer
+	}
+	for nickname, token := range found.Receivers {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(info.Token)) == 1 {
+			return *found, nickname, nil
+		}
+	}
+	return transfer{}, "", errNoSuchTransfer
+}
+
+/** Return the token receiver downloads transfer id with, or "" if it is not waiting for it. **/
+func (t *Transfers) DownloadToken(id string, receiver string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if found, ok := t.byID[id]; ok {
+		return found.Receivers[receiver]
+	}
+	return ""
+}
+
+/** Mark transfer id uploaded to path and return who it is for. **/
+func (t *Transfers) Uploaded(id string, path string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	found, ok := t.byID[id]
+	if !ok {
+		return nil
+	}
+	found.Path = path
+	found.Uploading = false
+	found.Ready = true
+
+	var receivers []string
+	for nickname := range found.Receivers {
+		receivers = append(receivers, nickname)
+	}
+	sort.Strings(receivers)
+	return receivers
+}
+
+/** Take nickname off the receivers of transfer id, dropping the transfer once nobody is left. **/
+func (t *Transfers) Finish(id string, nickname string) (transfer, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	found, ok := t.byID[id]
+	if !ok {
+		return transfer{}, errNoSuchTransfer
+	} else if _, waiting := found.Receivers[nickname]; !waiting {
+		return transfer{}, errNoSuchTransfer
+	}
+	delete(found.Receivers, nickname)
+	if len(found.Receivers) == 0 {
+		t.remove(id)
+	}
+	return *found, nil
+}
+
+/** Drop transfer id and its spooled copy. **/
+func (t *Transfers) Cancel(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(id)
+}
+
+/** Caller must hold t.mu. **/
+func (t *Transfers) remove(id string) {
+	if found, ok := t.byID[id]; ok && found.Path != "" {
+		os.Remove(found.Path)
+	}
+	delete(t.byID, id)
+}
+
+/** Caller must hold t.mu. Drop transfers older than fileTTL. **/
+func (t *Transfers) expire() {
+	for id, found := range t.byID {
+		if time.Since(found.Created) > fileTTL {
+			t.remove(id)
+		}
+	}
+}
+
+/** Make a new group for owner. **/
+func (g *Groups) Create(owner string, name string, members []string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	owned := g.byOwner[owner]
+	if owned == nil {
+		owned = make(map[string][]string)
+		g.byOwner[owner] = owned
+	}
+	if _, ok := owned[name]; ok {
+		return errGroupExists
+	} else if len(owned) >= groupLimit {
+		return errTooManyGroups
+	}
+	merged := addNames(nil, members)
+	if len(merged) > groupSize {
+		return errGroupFull
+	}
+	owned[name] = merged
+	return nil
+}
+
+/** Add members to owner's group name and return its members. **/
+func (g *Groups) Add(owner string, name string, members []string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	current, ok := g.byOwner[owner][name]
+	if !ok {
+		return nil, errNoSuchGroup
+	}
+	merged := addNames(current, members)
+	if len(merged) > groupSize {
+		return nil, errGroupFull
+	}
+	g.byOwner[owner][name] = merged
+	return merged, nil
+}
+
+/** Take members out of owner's group name and return who is left. **/
+func (g *Groups) Remove(owner string, name string, members []string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	current, ok := g.byOwner[owner][name]
+	if !ok {
+		return nil, errNoSuchGroup
+	}
+	var left []string
+	for _, member := range current {
+		if !containsName(members, member) {
+			left = append(left, member)
+		}
+	}
+	g.byOwner[owner][name] = left
+	return left, nil
+}
+
+/** Forget owner's group name. **/
+func (g *Groups) Delete(owner string, name string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.byOwner[owner][name]; !ok {
+		return errNoSuchGroup
+	}
+	delete(g.byOwner[owner], name)
+	return nil
+}
+
+/** Return the members of owner's group name. **/
+func (g *Groups) Members(owner string, name string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	current, ok := g.byOwner[owner][name]
+	if !ok {
+		return nil, errNoSuchGroup
+	}
+	return append([]string(nil), current...), nil
+}
+
+/** Return the names of owner's groups, sorted. **/
+func (g *Groups) Names(owner string) []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var names []string
+	for name := range g.byOwner[owner] {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/** Return list with the names not already in it appended. **/
+func addNames(list []string, names []string) []string {
+	list = append([]string(nil), list...)
+	for _, name := range names {
+		if name != "" && !containsName(list, name) {
+			list = append(list, name)
+		}
+	}
+	return list
+}
+
+func containsName(list []string, name string) bool {
+	for _, n := range list {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+/** Caller must hold s.mu. Drop sessions away for longer than resumeWindow. **/
+func (s *Sessions) expire() {
+	for token, sess := range s.byToken {
+		if !sess.Left.IsZero() && time.Since(sess.Left) > resumeWindow {
+			delete(s.byToken, token)
+		}
+	}
+}
+
+func main() {
+	flag.StringVar(&serverPort, "port", serverPort, "TCP port to listen on")
+	flag.IntVar(&protocol.MaxFrameSize, "maxframe", protocol.MaxFrameSize, "maximum size of a single request/response in bytes")
+	flag.IntVar(&queueSize, "queue", queueSize, "outbound messages queued per client")
+	flag.StringVar(&overflowPolicy, "overflow", overflowPolicy, "what to do when a client's queue is full: drop or disconnect")
+	flag.DurationVar(&writeTimeout, "writetimeout", writeTimeout, "deadline for writing one message to a client")
+	flag.DurationVar(&heartbeatInterval, "heartbeat", heartbeatInterval, "interval between heartbeats sent to each client (0 to disable)")
+	flag.DurationVar(&idleTimeout, "idletimeout", idleTimeout, "evict clients that send nothing for this long (0 to disable)")
+	flag.DurationVar(&resumeWindow, "resumewindow", resumeWindow, "how long a dropped client may come back and resume its session")
+	flag.IntVar(&resumeBuffer, "resumebuffer", resumeBuffer, "messages kept for a dropped client until it resumes")
+	flag.DurationVar(&readTimeout, "readtimeout", readTimeout, "how long a new connection may take to send its connect request")
+	flag.DurationVar(&shutdownTimeout, "shutdowntimeout", shutdownTimeout, "how long queued messages may take to go out when the server stops")
+	flag.IntVar(&maxClients, "maxclients", maxClients, "maximum number of users connected to the server")
+	flag.IntVar(&roomLimit, "roomlimit", roomLimit, "default capacity of the lobby and of new rooms")
+	flag.StringVar(&historyPath, "history", historyPath, "file to keep chat history in (empty to disable)")
+	flag.IntVar(&history.Window, "historywindow", history.Window, "newest history entries kept in memory for replays and \\history (0 for all)")
+	flag.IntVar(&replayCount, "replay", replayCount, "recent messages replayed to a client when it joins")
+	flag.IntVar(&historyPageSize, "historypage", historyPageSize, "messages per page for \\history")
+	flag.IntVar(&editableCount, "editable", editableCount, "newest messages that can still be edited, deleted or reacted to")
+	flag.DurationVar(&offlineTTL, "offlinettl", offlineTTL, "how long secret messages are held for users who are offline")
+	flag.IntVar(&offlineCap, "offlinecap", offlineCap, "maximum secret messages held per offline user")
+	flag.StringVar(&mailboxPath, "mailbox", mailboxPath, "file to keep secret messages for offline users in (empty to keep them in memory)")
+	flag.StringVar(&moderationPath, "moderation", moderationPath, "JSON file with moderation rules, reloaded on SIGHUP (empty for the built-in rules)")
+	flag.StringVar(&accountsPath, "accounts", accountsPath, "file to keep registered nicknames in (empty to disable registration)")
+	flag.StringVar(&operatorsPath, "operators", operatorsPath, "JSON file listing operator nicknames and the operator password")
+	flag.StringVar(&certFile, "cert", certFile, "TLS certificate file (enables TLS)")
+	flag.StringVar(&keyFile, "key", keyFile, "TLS private key file")
+	flag.BoolVar(&selfSigned, "selfsigned", selfSigned, "generate a self-signed certificate for local testing if -cert/-key don't exist")
+	flag.StringVar(&clientCAFile, "clientca", clientCAFile, "require client certificates signed by this CA; their CN becomes the nickname")
+	flag.StringVar(&dataPort, "dataport", dataPort, "TCP port for file transfers (empty to disable them)")
+	flag.Int64Var(&maxFileSize, "maxfile", maxFileSize, "largest file users may send, in bytes")
+	flag.DurationVar(&fileTTL, "filettl", fileTTL, "how long an offered file waits for its receivers")
+	flag.StringVar(&spoolDir, "spool", spoolDir, "directory to keep files in until they are downloaded (default: system temp)")
+	flag.StringVar(&webPort, "webport", webPort, "HTTP port serving the browser client and its WebSocket (empty to disable)")
+	flag.StringVar(&webOrigins, "weborigins", webOrigins, "comma-separated origins besides the server's own whose pages may open the WebSocket (* for any)")
+	flag.StringVar(&ircPort, "ircport", ircPort, "port IRC clients can join on (empty to disable)")
+	flag.StringVar(&metricsPort, "metricsport", metricsPort, "HTTP port serving Prometheus metrics at /metrics (empty to disable)")
+	if err := config.Parse("chatserver"); err != nil {
+		fmt.Println("Error reading configuration:", err)
+		os.Exit(1)
+	}
+
+	if overflowPolicy != overflowDrop && overflowPolicy != overflowDisconnect {
+		fmt.Println("Invalid overflow policy:", overflowPolicy)
+		os.Exit(1)
+	}
+	if queueSize < 1 {
+		fmt.Println("Queue size must be at least 1.")
+		os.Exit(1)
+	}
+	if historyPageSize < 1 || historyPageSize >= queueSize {
+		fmt.Println("History page size must be at least 1 and less than the queue size.")
+		os.Exit(1)
+	}
+
+	if historyPath != "" {
+		l, err := history.Open(historyPath)
+		if err != nil {
+			fmt.Println("Error opening history:", err)
+			os.Exit(1)
+		}
+		chatLog = l
+		defer chatLog.Close()
+		lastMessageID.Store(chatLog.LastID())
+
+		// Messages from before the restart can still be changed.
+		for _, entry := range chatLog.Recent(editableCount, func(entry history.Entry) bool { return entry.ID != 0 }) {
+			messages.Apply(entry, nil)
+		}
+	}
+
+	if operatorsPath != "" {
+		data, err := os.ReadFile(operatorsPath)
+		if err == nil {
+			err = json.Unmarshal(data, &operators)
+		}
+		if err != nil {
+			fmt.Println("Error loading operators:", err)
+			os.Exit(1)
+		}
+	}
+
+	if mailboxPath != "" {
+		m, err := openMailbox(mailboxPath)
+		if err != nil {
+			fmt.Println("Error loading mailbox:", err)
+			os.Exit(1)
+		}
+		mailbox = m
+	}
+
+	if accountsPath != "" {
+		store, err := accounts.Open(accountsPath)
+		if err != nil {
+			fmt.Println("Error loading accounts:", err)
+			os.Exit(1)
+		}
+		accountStore = store
+	}
+
+	pipeline, err := moderation.Load(moderationPath)
+	if err != nil {
+		fmt.Println("Error loading moderation rules:", err)
+		os.Exit(1)
+	}
+	moderator = pipeline
+
+	tlsConfig, err := setupTLS()
+	if err != nil {
+		fmt.Println("Error setting up TLS:", err)
+		os.Exit(1)
+	}
+
+	listner, err := net.Listen("tcp", ":"+serverPort)
+	if err != nil {
+		fmt.Println("Error listening:", err)
+		os.Exit(1)
+	}
+	if tlsConfig != nil {
+		listner = tls.NewListener(listner, tlsConfig)
+	}
+	defer listner.Close()
+
+	var dataListener net.Listener
+	if dataPort != "" {
+		spool, err := os.MkdirTemp(spoolDir, "chat-files-")
+		if err != nil {
+			fmt.Println("Error creating file spool:", err)
+			os.Exit(1)
+		}
+		spoolDir = spool
+		defer os.RemoveAll(spoolDir)
+
+		dataListener, err = net.Listen("tcp", ":"+dataPort)
+		if err != nil {
+			fmt.Println("Error listening:", err)
+			os.Exit(1)
+		}
+		if tlsConfig != nil {
+			dataListener = tls.NewListener(dataListener, tlsConfig)
+		}
+		defer dataListener.Close()
+	}
+
+	listeners := []net.Listener{listner}
+	if webPort != "" {
+		for _, origin := range strings.Split(webOrigins, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				webchat.AllowedOrigins = append(webchat.AllowedOrigins, origin)
+			}
+		}
+
+		webListener, err := net.Listen("tcp", ":"+webPort)
+		if err != nil {
+			fmt.Println("Error listening:", err)
+			os.Exit(1)
+		}
+		if tlsConfig != nil {
+			webListener = tls.NewListener(webListener, tlsConfig)
+		}
+		browsers := webchat.Listen(webListener)
+		defer browsers.Close()
+		listeners = append(listeners, browsers)
+	}
+	if ircPort != "" {
+		ircListener, err := net.Listen("tcp", ":"+ircPort)
+		if err != nil {
+			fmt.Println("Error listening:", err)
+			os.Exit(1)
+		}
+		if tlsConfig != nil {
+			ircListener = tls.NewListener(ircListener, tlsConfig)
+		}
+		listeners = append(listeners, irc.Listen(ircListener))
+	}
+
+	var metricsListener net.Listener
+	if metricsPort != "" {
+		metricsListener, err = net.Listen("tcp", ":"+metricsPort)
+		if err != nil {
+			fmt.Println("Error listening:", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Println("Server is ready to receive on port", serverPort)
+	if webPort != "" {
+		fmt.Println("Browser client is served on port", webPort)
+	}
+	if ircPort != "" {
+		fmt.Println("IRC clients can join on port", ircPort)
+	}
+	if metricsPort != "" {
+		fmt.Println("Metrics are served on port", metricsPort)
+	}
+
+	// Reloads moderation rules on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if err := moderator.Reload(); err != nil {
+				fmt.Println("[moderation] reload failed, keeping old rules:", err)
+			} else {
+				fmt.Println("[moderation] rules reloaded")
+			}
+		}
+	}()
+
+	// Shuts down when Ctrl-C is entered.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if dataListener != nil {
+		go serveData(ctx, dataListener)
+	}
+	if metricsListener != nil {
+		go serveMetrics(ctx, metricsListener)
+	}
+	serve(ctx, listeners...)
+	fmt.Println("\nBye bye~")
+}
+
+/** Accept and serve clients from every listener until ctx is done, then shut down gracefully. Tests can cancel ctx instead of sending a signal. **/
+func serve(ctx context.Context, listeners ...net.Listener) {
+	go func() {
+		<-ctx.Done()
+		for _, listner := range listeners {
+			listner.Close()
+		}
+	}()
+
+	// TCP and browser clients meet here so they share IDs and limits.
+	accepted := make(chan net.Conn)
+	var accepting sync.WaitGroup
+	for _, listner := range listeners {
+		accepting.Add(1)
+		go func(listner net.Listener) {
+			defer accepting.Done()
+			for {
+				conn, err := listner.Accept()
+				if err != nil {
+					if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+						return
+					}
+					fmt.Println("Error accepting connection.")
+					continue
+				}
+				accepted <- conn
+			}
+		}(listner)
+	}
+	go func() {
+		accepting.Wait()
+		close(accepted)
+	}()
+
+	// Every accepted connection, so shutdown can close the ones still in the handshake.
+	var connsMu sync.Mutex
+	conns := make(map[net.Conn]bool)
+	var handlers sync.WaitGroup
+
+	newClientID := 0
+
+	// Accept connection
+	for conn := range accepted {
+		connsMu.Lock()
+		conns[conn] = true
+		connsMu.Unlock()
+
+		// Everything after accepting happens off the accept loop, so one slow client can't hold up the rest.
+		handlers.Add(1)
+		go func(conn net.Conn, id int) {
+			defer handlers.Done()
+			defer func() {
+				connsMu.Lock()
+				delete(conns, conn)
+				connsMu.Unlock()
+			}()
+
+			if ip, _ := remoteAddr(conn); sanctions.Banned("", ip) {
+				denyConn(conn, protocol.ReasonBanned, "[You are banned from this server.]")
+			} else if clients.Len() >= maxClients {
+				denyConn(conn, protocol.ReasonFull, roomFullMessage)
+			} else if newClient := initConn(conn, id); newClient != nil {
+				handleConn(newClient)
+			}
+		}(conn, newClientID)
+		newClientID++
+	}
+
+	shutdown(shutdownTimeout)
+
+	connsMu.Lock()
+	for conn := range conns {
+		conn.Close()
+	}
+	connsMu.Unlock()
+	handlers.Wait()
+}
+
+/** Tell every client the server is closing and let their queues flush for up to timeout before closing them. **/
+func shutdown(timeout time.Duration) {
+	notice, _ := protocol.EncodeResponse(protocol.NewResponse(protocol.ResTerminated, "[Chat server is closed.]"))
+
+	remaining := clients.Close()
+	for _, client := range remaining {
+		client.Send(notice)
+		client.Close()
+	}
+
+	deadline := time.After(timeout)
+	for _, client := range remaining {
+		select {
+		case <-client.done:
+		case <-deadline:
+			fmt.Println("Shutdown timed out; closing remaining connections.")
+			for _, client := range remaining {
+				client.Conn.Close()
+			}
+			return
+		}
+	}
+}
+
+/** Accept data connections for file transfers until ctx is done. **/
+func serveData(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			fmt.Println("Error accepting data connection.")
+			continue
+		}
+		go handleData(conn)
+	}
+}
+
+/** Serve /metrics on listener until ctx is done, then let scrapes in progress finish. **/
+func serveMetrics(ctx context.Context, listener net.Listener) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: readTimeout}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	// The server closes listener on Shutdown.
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed && ctx.Err() == nil {
+		fmt.Println("Error serving metrics:", err)
+	}
+}
+
+/** Carry one upload or download. The first frame says which, the file's bytes follow. **/
+func handleData(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	request, err := protocol.ReadRequest(conn)
+	if err != nil {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(fileTTL))
+
+	if request.Body.File == nil {
+		protocol.WriteResponse(conn, protocol.NewResponse(protocol.ResError, "[no file given.]"))
+		return
+	}
+
+	// The token says who is on the other end; the nickname in the request is not trusted.
+	if request.Header.Code == protocol.ReqUpload {
+		found, err := transfers.StartUpload(*request.Body.File)
+		if err == nil {
+			receiveFile(conn, found)
+			return
+		}
+	} else if request.Header.Code == protocol.ReqDownload {
+		found, receiver, err := transfers.StartDownload(*request.Body.File)
+		if err == nil {
+			sendFile(conn, found, receiver)
+			return
+		}
+	}
+	protocol.WriteResponse(conn, protocol.NewResponse(protocol.ResError, "[no such file transfer.]"))
+}
+
+/** Spool an upload, check its hash and offer it to its receivers. **/
+func receiveFile(conn net.Conn, found transfer) {
+	info := found.Info
+	fail := func(reason string) {
+		transfers.Cancel(info.ID)
+		protocol.WriteResponse(conn, protocol.NewResponse(protocol.ResError, fmt.Sprintf("[upload of %s failed: %s]", info.Name, reason)))
+	}
+
+	file, err := os.CreateTemp(spoolDir, "upload-*")
+	if err != nil {
+		fmt.Println("Error spooling file:", err)
+		fail("server error")
+		return
+	}
+	err = filetransfer.Copy(file, conn, info.Size, info.Hash, nil)
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		fail(err.Error())
+		return
+	}
+
+	receivers := transfers.Uploaded(info.ID, file.Name())
+	fmt.Printf("[%s uploaded %s (%s) for %s.]\n", found.Sender, info.Name, filetransfer.FormatSize(info.Size), strings.Join(receivers, ", "))
+
+	var waiting []string
+	for _, nickname := range receivers {
+		if client := clients.ByNickname(nickname); client != nil {
+			// Each receiver downloads with a token of its own.
+			offered := info
+			offered.Token = transfers.DownloadToken(info.ID, nickname)
+			offer := protocol.NewResponse(protocol.ResOffer, "")
+			offer.Sender = found.Sender
+			offer.File = &offered
+			offer.DataPort = dataPort
+			client.Reply(offer)
+			waiting = append(waiting, nickname)
+		} else {
+			transfers.Finish(info.ID, nickname)
+		}
+	}
+
+	msg := fmt.Sprintf("[sent %s. waiting for %s to accept.]", info.Name, strings.Join(waiting, ", "))
+	if len(waiting) == 0 {
+		msg = fmt.Sprintf("[sent %s, but nobody it was for is here anymore.]", info.Name)
+	}
+	protocol.WriteResponse(conn, protocol.NewResponse(protocol.ResReply, msg))
+}
+
+/** Stream a spooled file to one of its receivers and tell the sender. **/
+func sendFile(conn net.Conn, found transfer, nickname string) {
+	file, err := os.Open(found.Path)
+	if err != nil {
+		protocol.WriteResponse(conn, protocol.NewResponse(protocol.ResError, "[no such file transfer.]"))
+		return
+	}
+	defer file.Close()
+
+	info := found.Info
+	info.Token = ""
+	response := protocol.NewResponse(protocol.ResReply, "")
+	response.File = &info
+	if err := protocol.WriteResponse(conn, response); err != nil {
+		return
+	}
+	if _, err := io.CopyN(conn, file, info.Size); err != nil {
+		return
+	}
+
+	transfers.Finish(info.ID, nickname)
+	if sender := clients.ByNickname(found.Sender); sender != nil {
+		sender.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[%s received %s.]", nickname, info.Name)))
+	}
+}
+
+/** Return the TLS config asked for by flags, or nil for plain TCP. **/
+func setupTLS() (*tls.Config, error) {
+	if selfSigned {
+		if certFile == "" {
+			certFile = "server.crt"
+		}
+		if keyFile == "" {
+			keyFile = "server.key"
+		}
+
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			hostname, _ := os.Hostname()
+			certPEM, keyPEM, err := tlsutil.GenerateSelfSigned([]string{"localhost", "127.0.0.1", "::1", hostname}, 365*24*time.Hour)
+			if err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+				return nil, err
+			}
+			fmt.Printf("Generated self-signed certificate %s\n", certFile)
+		}
+	}
+
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+
+	config, err := tlsutil.ServerConfig(certFile, keyFile, clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if fingerprint, err := tlsutil.FileFingerprint(certFile); err == nil {
+		fmt.Println("TLS certificate SHA-256 fingerprint:", fingerprint)
+	}
+	return config, nil
+}
+
+/** Initialize connection. **/
+func initConn(conn net.Conn, newClientID int) *Client {
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	request, err := protocol.ReadRequest(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		fmt.Println("client disconnected")
+		return nil
+	}
+	requestsTotal.With(strconv.Itoa(int(request.Header.Code))).Inc()
+
+	// With mutual TLS the certificate decides the nickname and stands in for the password.
+	nickname := request.Header.Sender
+	certified := false
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if cn := tlsutil.PeerCommonName(tlsConn); cn != "" {
+			nickname = cn
+			certified = true
+		}
+	}
+
+	if !protocol.ValidNickname(nickname) {
+		denyConn(conn, protocol.ReasonNickname, fmt.Sprintf("[invalid nickname: English letters only, %d or less. cannot connect.]", protocol.MaxNicknameLength))
+		return nil
+	}
+
+	if sanctions.Banned(nickname, "") {
+		denyConn(conn, protocol.ReasonBanned, "[You are banned from this server.]")
+		return nil
+	}
+
+	// A session token from before a disconnect stands in for the passwords.
+	resume, resuming := sessions.Lookup(request.Body.Session, nickname)
+
+	if !certified && !resuming && !login(conn, nickname, request.Body.Password) {
+		return nil
+	}
+
+	client := newClient(newClientID, nickname, conn)
+	client.PublicKey = request.Body.PublicKey
+
+	if resuming {
+		client.Operator = resume.Operator
+		client.Author = resume.Author
+
+		// The old connection may not have noticed it is dead yet.
+		if old := clients.ByNickname(nickname); old != nil && old.Session == request.Body.Session {
+			old.Close()
+			dropClient(old)
+			resume, resuming = sessions.Lookup(request.Body.Session, nickname)
+		}
+	} else if request.Body.OperatorPassword != "" {
+		if !checkOperatorPassword(request.Body.OperatorPassword) {
+			denyConn(conn, protocol.ReasonPassword, "[wrong operator password. cannot connect.]")
+			return nil
+		}
+		client.Operator = true
+	} else {
+		client.Operator = isOperatorNickname(client.Nickname)
+	}
+
+	// A resumed client stays the author of its session's messages.
+	if !resuming && (certified || (accountStore != nil && accountStore.Registered(nickname))) {
+		client.Author = "account:" + nickname
+	} else if !resuming {
+		client.Author = "session:" + newToken()
+	}
+
+	activeClients, err := clients.Add(client.ID, client.Nickname, client, maxClients)
+	if err == registry.ErrFull {
+		denyConn(conn, protocol.ReasonFull, roomFullMessage)
+		return nil
+
+	} else if err == registry.ErrClosed {
+		err := protocol.WriteResponse(conn, protocol.NewResponse(protocol.ResTerminated, "[Chat server is closed.]"))
+		if err != nil {
+			fmt.Println("Error sending response.")
+			writeErrors.Inc()
+		}
+		conn.Close()
+		return nil
+
+	} else if err != nil {
+		denyConn(conn, protocol.ReasonNicknameUsed, "[nickname already used by another user. cannot connect.]")
+		return nil
+	}
+
+	activeClients, err = rooms.Join(client, lobby)
+	if err != nil {
+		clients.Remove(client.ID)
+		denyConn(conn, protocol.ReasonFull, roomFullMessage)
+		return nil
+	}
+
+	var missed []history.Entry
+	if resuming {
+		missed, resuming = sessions.Attach(request.Body.Session, client)
+	}
+	if resuming {
+		client.Session = request.Body.Session
+		if resume.Room != "" && resume.Room != lobby {
+			if count, err := rooms.Join(client, resume.Room); err == nil {
+				activeClients = count
+			}
+		}
+	} else {
+		client.Session = sessions.Start(client)
+	}
+
+	msg := fmt.Sprintf("[Welcome %s to CAU net-class chat room at %s.]\n[There are %d users in the room.]", client.Nickname, conn.LocalAddr(), activeClients)
+	if resuming {
+		msg = fmt.Sprintf("[Welcome back %s. You are in %s with %d users.]", client.Nickname, rooms.Of(client), activeClients)
+	}
+	if client.Operator {
+		msg += "\n[You are an operator.]"
+	}
+	welcome := roomEvent(protocol.ResReply, msg, protocol.EventJoin, client.Nickname, rooms.Of(client))
+	welcome.Session = client.Session
+	err = protocol.WriteResponse(conn, welcome)
+	if err != nil {
+		fmt.Println("Error sending response.")
+		writeErrors.Inc()
+	}
+
+	publicKeys.Publish(client.Nickname, client.PublicKey)
+	if resuming {
+		sendMissed(client, missed)
+	} else {
+		replayHistory(client)
+	}
+	deliverHeld(client)
+
+	// Anything broadcast since Add waits in the queue until the welcome is out.
+	go client.writeLoop()
+	go client.heartbeat()
+
+	if resuming {
+		room := rooms.Of(client)
+		msg = fmt.Sprintf("[%s is back. There are %d users now.]", client.Nickname, activeClients)
+		fmt.Println(msg)
+		response, _ := protocol.EncodeResponse(roomEvent(protocol.ResMessage, msg, protocol.EventJoin, client.Nickname, room))
+		roomcast(room, response, client.ID)
+		record(history.Entry{Kind: history.KindSystem, Room: room, Message: msg})
+		return client
+	}
+
+	msg = fmt.Sprintf("[%s joined from %s. There are %d users in the room.]", client.Nickname, conn.RemoteAddr(), activeClients)
+	fmt.Println(msg)
+	record(history.Entry{Kind: history.KindSystem, Room: lobby, Message: fmt.Sprintf("[%s joined the room. There are %d users now.]", client.Nickname, activeClients)})
+	return client
+}
+
+const roomFullMessage = "chatting room full. cannot connect"
+
+/** Check the password of a registered nickname, throttling repeated failures. Unregistered nicknames pass. **/
+func login(conn net.Conn, nickname string, password string) bool {
+	if accountStore == nil || !accountStore.Registered(nickname) {
+		return true
+	}
+
+	ip, _ := remoteAddr(conn)
+	wait := loginThrottle.Wait(nickname)
+	if w := loginThrottle.Wait(ip); w > wait {
+		wait = w
+	}
+	if wait > 0 {
+		denyConn(conn, protocol.ReasonPassword, fmt.Sprintf("[too many failed logins. try again in %s.]", wait.Round(time.Second)))
+		return false
+	}
+
+	if password == "" {
+		denyConn(conn, protocol.ReasonPassword, fmt.Sprintf("[%s is a registered nickname. password required.]", nickname))
+		return false
+	}
+
+	if !accountStore.Verify(nickname, password) {
+		loginThrottle.Fail(nickname)
+		loginThrottle.Fail(ip)
+		fmt.Printf("[failed login for %s from %s]\n", nickname, ip)
+		denyConn(conn, protocol.ReasonPassword, fmt.Sprintf("[wrong password for %s. cannot connect.]", nickname))
+		return false
+	}
+
+	loginThrottle.Succeed(nickname)
+	loginThrottle.Succeed(ip)
+	return true
+}
+
+/** Register the client's nickname with password. **/
+func register(client *Client, password string) {
+	if accountStore == nil {
+		client.Reply(protocol.NewResponse(protocol.ResReply, "[registration is disabled on this server.]"))
+		return
+	}
+
+	err := accountStore.Register(client.Nickname, password)
+	if err == accounts.ErrRegistered {
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[%s is already registered.]", client.Nickname)))
+	} else if err == accounts.ErrEmptyPassword {
+		client.Reply(protocol.NewResponse(protocol.ResReply, "[Please enter a password.]"))
+	} else if err != nil {
+		fmt.Println("Error saving accounts:", err)
+		client.Reply(protocol.NewResponse(protocol.ResReply, "[registration failed. please try again later.]"))
+	} else {
+		fmt.Printf("[%s registered their nickname.]\n", client.Nickname)
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[%s is now registered. use the same password to join next time.]", client.Nickname)))
+	}
+}
+
+/** Return whether password is the configured operator password. **/
+func checkOperatorPassword(password string) bool {
+	if operators.Password == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(operators.Password)) == 1
+}
+
+/** Return whether nickname is listed as an operator. **/
+func isOperatorNickname(nickname string) bool {
+	for _, op := range operators.Nicknames {
+		if op == nickname {
+			return true
+		}
+	}
+	return false
+}
+
+/** Return the host and port conn comes from. An address without a port, like a Unix socket's, comes back whole. **/
+func remoteAddr(conn net.Conn) (string, string) {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return "", ""
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String(), ""
+	}
+	return host, port
+}
+
+/** Deny new connection. **/
+func denyConn(conn net.Conn, reason string, message string) {
+	response := protocol.NewResponse(protocol.ResError, message)
+	response.Reason = reason
+	rejectedConns.With(reason).Inc()
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout)) // a client that doesn't read can't keep us here
+	err := protocol.WriteResponse(conn, response)
+	if err != nil {
+		fmt.Println("Error sending response.")
+		writeErrors.Inc()
+	}
+	conn.Close()
+}
+
+/** Handle each connection. **/
+func handleConn(client *Client) {
+	defer client.Close()
+
+	for {
+		if idleTimeout > 0 {
+			client.Conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		}
+
+		packet, err := protocol.ReadFrame(client.Conn)
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			fmt.Printf("[%s timed out after %s without a word.]\n", client.Nickname, idleTimeout)
+			client.Reply(protocol.NewResponse(protocol.ResError, "[You are disconnected for not responding.]"))
+			dropClient(client)
+			break
+		} else if err == protocol.ErrFrameTooLarge {
+			// The payload is left unread, so the connection can't go on. The session stays resumable.
+			msg := fmt.Sprintf("[message too long. limit is %d bytes.]", protocol.MaxFrameSize)
+			client.Reply(protocol.NewResponse(protocol.ResReply, msg))
+			dropClient(client)
+			break
+		} else if err != nil {
+			dropClient(client)
+			break
+		}
+
+		receivedBytes.Add(float64(protocol.FrameHeaderSize + len(packet)))
+
+		request, err := protocol.DecodeRequest(packet)
+		if err != nil {
+			fmt.Println("Error decoding packet:", err)
+			continue
+		}
+
+		requestCode := request.Header.Code
+		requestsTotal.With(strconv.Itoa(int(requestCode))).Inc()
+
+		if relayedCodes[requestCode] && !fitsRelayed(client, request) {
+			msg := fmt.Sprintf("[message too long to pass on. limit is %d bytes with your nickname and the server's additions.]", protocol.MaxFrameSize)
+			client.Reply(protocol.NewResponse(protocol.ResReply, msg))
+			continue
+		}
+
+		if requestCode == protocol.ReqBroadcast || requestCode == protocol.ReqSecret || requestCode == protocol.ReqExcept || requestCode == protocol.ReqEdit || requestCode == protocol.ReqReact || requestCode == protocol.ReqOffer {
+			verdict := moderate(client, request)
+			if verdict >= moderation.Kick {
+				break
+			} else if verdict >= moderation.Drop {
+				continue
+			}
+		}
+
+		if requestCode == protocol.ReqBroadcast { // default (send to all)
+			room := rooms.Of(client)
+			msg := chatMessage(client, fmt.Sprintf("%s> %s", client.Nickname, request.Body.Message))
+			response, _ := protocol.EncodeResponse(msg)
+			roomcast(room, response, client.ID)
+			client.Reply(receipt(msg.ID, client.Nickname, protocol.ReceiptSent))
+			record(history.Entry{ID: msg.ID, Kind: history.KindBroadcast, Room: room, Sender: client.Nickname, Author: client.Author, Message: request.Body.Message})
+
+		} else if requestCode == protocol.ReqList { // \ls
+			var info strings.Builder
+			var members []string
+			byRoom := make(map[string][]string)
+			for _, name := range rooms.Names() {
+				info.WriteString(fmt.Sprintf("[%s]\n", rooms.Describe(name)))
+				byRoom[name] = []string{}
+				for _, c := range rooms.Members(name) {
+					host, port := remoteAddr(c.Conn)
+					info.WriteString(fmt.Sprintf("<%s, %s, %s>\n", c.Nickname, host, port))
+					members = append(members, c.Nickname)
+					byRoom[name] = append(byRoom[name], c.Nickname)
+				}
+			}
+			response := protocol.NewResponse(protocol.ResMessage, info.String())
+			response.Members = members
+			response.Rooms = byRoom
+			client.Reply(response)
+
+		} else if requestCode == protocol.ReqSecret { // \secret
+			targets := request.Header.Targets()
+			if request.Body.Encrypted && (len(targets) != 1 || strings.HasPrefix(targets[0], protocol.GroupPrefix)) {
+				client.Reply(protocol.NewResponse(protocol.ResReply, "[an encrypted secret is sealed for one nickname only. message not sent.]"))
+				continue
+			}
+
+			// Each receiver gets its own copy, so receipts and edits stay between the two of them.
+			receivers, _ := resolveTargets(client, targets)
+			for _, receiver := range receivers {
+				held := offlineMessage{ID: lastMessageID.Add(1), Sender: client.Nickname, Message: request.Body.Message, Sent: time.Now(), Encrypted: request.Body.Encrypted}
+				if secret(client, receiver, held) {
+					text := request.Body.Message
+					if held.Encrypted {
+						text = "[encrypted]"
+					}
+					record(history.Entry{ID: held.ID, Kind: history.KindSecret, Sender: client.Nickname, Author: client.Author, Receiver: receiver, Message: text, Encrypted: held.Encrypted})
+				}
+			}
+
+		} else if requestCode == protocol.ReqGetKey { // public key lookup
+			response := protocol.NewResponse(protocol.ResPublicKey, "")
+			response.Sender = request.Header.Receiver
+			response.PublicKey = publicKeys.Lookup(request.Header.Receiver)
+			client.Reply(response)
+
+		} else if requestCode == protocol.ReqExcept { // \except
+			// A name that can't be left out would see the message, so nothing is sent then.
+			excluded, ok := resolveTargets(client, request.Header.Targets())
+			for _, nickname := range excluded {
+				if clients.ByNickname(nickname) == nil {
+					client.Reply(targetError(nickname, fmt.Sprintf("[no such user: %s]", nickname)))
+					ok = false
+				}
+			}
+			if !ok {
+				client.Reply(protocol.NewResponse(protocol.ResReply, "[message not sent.]"))
+				continue
+			}
+
+			msg := chatMessage(client, fmt.Sprintf("%s> %s", client.Nickname, request.Body.Message))
+			response, _ := protocol.EncodeResponse(msg)
+			except(response, client, excluded)
+			client.Reply(receipt(msg.ID, client.Nickname, protocol.ReceiptSent))
+			entry := history.Entry{ID: msg.ID, Kind: history.KindExcept, Room: rooms.Of(client), Sender: client.Nickname, Author: client.Author, Message: request.Body.Message}
+			if len(excluded) == 1 {
+				entry.Receiver = excluded[0]
+			} else {
+				entry.Receivers = excluded
+			}
+			record(entry)
+
+		} else if requestCode == protocol.ReqTyping { // typing notification
+			typing(client, request.Header.Targets())
+
+		} else if requestCode == protocol.ReqRead { // read receipt
+			id, err := strconv.ParseUint(request.Body.Message, 10, 64)
+			if sender, ok := receipts.Read(id, client.Nickname); err == nil && ok {
+				if target := clients.ByNickname(sender); target != nil {
+					target.Reply(receipt(id, client.Nickname, protocol.ReceiptRead))
+				}
+			}
+
+		} else if requestCode == protocol.ReqEdit || requestCode == protocol.ReqDelete || requestCode == protocol.ReqReact { // \edit, \delete, \react
+			changeMessage(client, request)
+
+		} else if requestCode == protocol.ReqGroup { // \group
+			manageGroup(client, request)
+
+		} else if requestCode == protocol.ReqOffer { // \send
+			offerFile(client, request)
+
+		} else if requestCode == protocol.ReqDecline { // \decline
+			declineFile(client, request.Header.Receiver)
+
+		} else if requestCode == protocol.ReqPing && request.Body.Message == protocol.Heartbeat { // heartbeat reply
+			// Reading it already pushed the idle deadline back.
+
+		} else if requestCode == protocol.ReqPing { // \ping
+			client.Reply(protocol.NewResponse(protocol.ResRTT, ""))
+
+		} else if requestCode == protocol.ReqCreateRoom { // \create
+			createRoom(client, request.Header.Receiver, request.Body.Message)
+
+		} else if requestCode == protocol.ReqJoinRoom { // \join
+			joinRoom(client, request.Header.Receiver)
+
+		} else if requestCode == protocol.ReqLeaveRoom { // \leave
+			if rooms.Of(client) == lobby {
+				client.Reply(failure(protocol.ReasonInRoom, "[You are already in the lobby.]"))
+			} else {
+				joinRoom(client, lobby)
+			}
+
+		} else if requestCode == protocol.ReqListRooms { // \rooms
+			var info strings.Builder
+			for _, name := range rooms.Names() {
+				info.WriteString(rooms.Describe(name) + "\n")
+			}
+			client.Reply(protocol.NewResponse(protocol.ResMessage, info.String()))
+
+		} else if requestCode == protocol.ReqHistory { // \history
+			sendHistory(client, request.Body.Message)
+
+		} else if requestCode >= protocol.ReqKick && requestCode <= protocol.ReqSetLimit { // operator commands
+			if !client.Operator {
+				client.Reply(protocol.NewResponse(protocol.ResReply, "[permission denied: only operators can use this command.]"))
+			} else {
+				operate(client, request)
+			}
+
+		} else if requestCode == protocol.ReqRegister { // \register
+			register(client, request.Body.Password)
+
+		} else if requestCode == protocol.ReqQuit { // \quit
+			sessions.End(client.Session, client.ID)
+			removeClient(client)
+			break
+
+		} else {
+			msg := fmt.Sprintf("invalid command: %s", request.Body.Message)
+			client.Reply(protocol.NewResponse(protocol.ResReply, msg))
+		}
+	}
+}
+
+/** Run a chat message through mutes and moderation rules, act on the verdict and return the action taken. **/
+func moderate(client *Client, request protocol.Request) moderation.Action {
+	if left := sanctions.Muted(client.Nickname); left > 0 {
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[You are muted for %s more. message not sent.]", left.Round(time.Second))))
+		return moderation.Drop
+	}
+
+	ip, _ := remoteAddr(client.Conn)
+	verdict := moderator.Check(moderation.Message{Nickname: client.Nickname, IP: ip, Text: request.Body.Message})
+	if verdict.Action == moderation.Allow {
+		return moderation.Allow
+	}
+
+	fmt.Printf("[moderation] %s %s (%s): %s [%s]\n", verdict.Action, client.Nickname, ip, verdict.Reason, verdict.Rule)
+
+	switch verdict.Action {
+	case moderation.Warn:
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[Warning: you %s.]", verdict.Reason)))
+
+	case moderation.Drop:
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[message not sent: you %s.]", verdict.Reason)))
+
+	case moderation.Mute:
+		sanctions.Mute(client.Nickname, verdict.Duration)
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[You are muted for %s: you %s.]", verdict.Duration, verdict.Reason)))
+
+	case moderation.Kick:
+		kickClient(client, "", "[You are kicked out of the chat room.]")
+
+	case moderation.Ban:
+		if verdict.BanBy == moderation.BanIP {
+			sanctions.BanIP(ip)
+		} else {
+			sanctions.BanNickname(client.Nickname)
+		}
+		kickClient(client, "", "[You are banned from this server.]")
+	}
+
+	return verdict.Action
 }
 
-type Client struct {
-	ID       int
-	Nickname string
-	Conn     net.Conn
+/** Carry out an operator command. The caller has checked privileges. **/
+func operate(op *Client, request protocol.Request) {
+	target := request.Header.Receiver
+	arg := request.Body.Message
+	reply := func(format string, a ...interface{}) {
+		op.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf(format, a...)))
+	}
+
+	switch request.Header.Code {
+	case protocol.ReqKick:
+		client := clients.ByNickname(target)
+		if client == nil {
+			reply("[no such user: %s]", target)
+			return
+		}
+		reason := "[You are kicked out of the chat room.]"
+		if arg != "" {
+			reason = fmt.Sprintf("[You are kicked out of the chat room: %s]", arg)
+		}
+		fmt.Printf("[operator] %s kicked %s\n", op.Nickname, target)
+		kickClient(client, op.Nickname, reason)
+		reply("[%s has been kicked.]", target)
+
+	case protocol.ReqBan:
+		if target == "" {
+			reply("[Please enter a nickname or IP to ban.]")
+			return
+		}
+		if net.ParseIP(target) != nil {
+			sanctions.BanIP(target)
+			for _, client := range clients.Snapshot() {
+				if ip, _ := remoteAddr(client.Conn); ip == target {
+					kickClient(client, op.Nickname, "[You are banned from this server.]")
+				}
+			}
+		} else {
+			sanctions.BanNickname(target)
+			if client := clients.ByNickname(target); client != nil {
+				kickClient(client, op.Nickname, "[You are banned from this server.]")
+			}
+		}
+		fmt.Printf("[operator] %s banned %s\n", op.Nickname, target)
+		reply("[%s has been banned.]", target)
+
+	case protocol.ReqUnban:
+		if !sanctions.Unban(target) {
+			reply("[%s is not banned.]", target)
+			return
+		}
+		fmt.Printf("[operator] %s unbanned %s\n", op.Nickname, target)
+		reply("[%s has been unbanned.]", target)
+
+	case protocol.ReqMute:
+		duration := 5 * time.Minute
+		if arg != "" {
+			d, err := time.ParseDuration(arg)
+			if err != nil || d < 0 {
+				reply("[invalid duration: %s]", arg)
+				return
+			}
+			duration = d
+		}
+		if duration == 0 {
+			sanctions.Unmute(target)
+			fmt.Printf("[operator] %s unmuted %s\n", op.Nickname, target)
+			reply("[%s has been unmuted.]", target)
+			return
+		}
+		sanctions.Mute(target, duration)
+		if client := clients.ByNickname(target); client != nil {
+			client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[You are muted for %s by an operator.]", duration)))
+		}
+		fmt.Printf("[operator] %s muted %s for %s\n", op.Nickname, target, duration)
+		reply("[%s has been muted for %s.]", target, duration)
+
+	case protocol.ReqAnnounce:
+		msg := fmt.Sprintf("[Announcement from %s] %s", op.Nickname, arg)
+		response, _ := protocol.EncodeResponse(protocol.NewResponse(protocol.ResMessage, msg))
+		broadcast(response, -1)
+		for _, room := range rooms.Names() {
+			record(history.Entry{Kind: history.KindSystem, Room: room, Message: msg})
+		}
+		fmt.Printf("[operator] %s announced: %s\n", op.Nickname, arg)
+
+	case protocol.ReqSetLimit:
+		limit, err := strconv.Atoi(arg)
+		if err != nil || limit < 1 {
+			reply("[invalid room limit: %s]", arg)
+			return
+		}
+		if target == "" {
+			target = rooms.Of(op)
+		}
+		if err := rooms.SetLimit(target, limit); err != nil {
+			reply("[no such room: %s]", target)
+			return
+		}
+		fmt.Printf("[operator] %s set the limit of %s to %d\n", op.Nickname, target, limit)
+		reply("[%s now holds up to %d users.]", target, limit)
+	}
 }
 
-var clients []*Client
+/** Tell the client why with Code 3, disconnect it and remove it. **/
+func kickClient(client *Client, by string, reason string) {
+	if by == "" {
+		kicksTotal.With("moderation").Inc()
+	} else {
+		kicksTotal.With("operator").Inc()
+	}
 
-func main() {
-	serverPort := "30768"
+	response := protocol.NewResponse(protocol.ResError, reason)
+	response.Sender = by
+	response.Reason = protocol.ReasonKicked
+	client.Reply(response)
+	client.Close()
+	sessions.End(client.Session, client.ID)
+	removeClient(client)
+}
 
-	listner, err := net.Listen("tcp", ":"+serverPort)
-	if err != nil {
-		fmt.Println("Error listening:", err)
-		os.Exit(1)
+/** Broadcast message **/
+func broadcast(msg []byte, senderID int) {
+	start := time.Now()
+	defer func() { fanoutSeconds.Observe(time.Since(start).Seconds()) }()
+
+	for _, client := range clients.Snapshot() {
+		if client.ID != senderID {
+			client.Send(msg)
+		}
 	}
-	defer listner.Close()
+}
 
-	activeClients := 0
-	newClientID := 0
+/** Send message to everyone in room except the sender. **/
+func roomcast(room string, msg []byte, senderID int) {
+	start := time.Now()
+	defer func() { fanoutSeconds.Observe(time.Since(start).Seconds()) }()
 
-	fmt.Println("Server is ready to receive on port", serverPort)
+	for _, client := range rooms.Members(room) {
+		if client.ID != senderID {
+			client.Send(msg)
+		}
+	}
+}
 
-	// Exits when Ctrl-C is entered.
-	sig := make(chan os.Signal, 1)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+/** Send secret message, holding it if the receiver is offline, tell the sender what happened and return whether it was accepted. **/
+func secret(sender *Client, receiver string, msg offlineMessage) bool {
+	client := clients.ByNickname(receiver)
+	if client != nil {
+		client.Reply(secretResponse(msg, false))
+		receipts.Track(msg.ID, sender.Nickname, receiver)
+		sender.Reply(receipt(msg.ID, receiver, protocol.ReceiptDelivered))
+		return true
+	}
 
-	go func() {
-		<-sig
-		response, _ := json.Marshal(Response{Code: 4, Message: "[Chat server is closed.]"})
-		broadcast(response, -1)
-		fmt.Println("\nBye bye~")
-		listner.Close()
-		os.Exit(0)
-	}()
+	err := mailbox.Hold(receiver, msg)
+	if err == errUnknownNickname {
+		sender.Reply(targetError(receiver, fmt.Sprintf("[no such user: %s]", receiver)))
+		return false
+	} else if err == errMailboxFull {
+		sender.Reply(targetError(receiver, fmt.Sprintf("[%s is offline and has too many messages waiting. not delivered.]", receiver)))
+		return false
+	}
 
-	// Accept connection
-	for {
-		conn, err := listner.Accept()
-		if err != nil {
-			if opErr, ok := err.(*net.OpError); ok && opErr.Err.Error() == "use of closed network connection" {
-				break
+	text := fmt.Sprintf("[%s is offline. message #%d will be delivered when they return.]", receiver, msg.ID)
+	if accountStore == nil || !accountStore.Registered(receiver) {
+		// Anyone can join with a nickname that isn't registered and collect its mail.
+		text = fmt.Sprintf("[%s is offline. message #%d will be delivered to whoever joins as %s next; the nickname isn't registered, so it may not be them.]", receiver, msg.ID, receiver)
+	}
+	response := protocol.NewResponse(protocol.ResReply, text)
+	response.ID = msg.ID
+	sender.Reply(response)
+	return true
+}
+
+/** Return a chat message from sender with a new ID. **/
+func chatMessage(sender *Client, text string) protocol.Response {
+	response := protocol.NewResponse(protocol.ResMessage, text)
+	response.Sender = sender.Nickname
+	response.ID = lastMessageID.Add(1)
+	response.Time = time.Now().UnixMilli()
+	return response
+}
+
+/** Return a receipt telling a sender that who got or read message id. **/
+func receipt(id uint64, who string, status string) protocol.Response {
+	response := protocol.NewResponse(protocol.ResReceipt, status)
+	response.ID = id
+	response.Sender = who
+	return response
+}
+
+/** Tell targets, or the client's room if there are none, that the client is typing. **/
+func typing(client *Client, targets []string) {
+	if sanctions.Muted(client.Nickname) > 0 {
+		return
+	}
+
+	notice := protocol.NewResponse(protocol.ResTyping, "")
+	notice.Sender = client.Nickname
+
+	if len(targets) > 0 {
+		notice.Private = true
+		for _, receiver := range expandGroups(client, targets) {
+			if target := clients.ByNickname(receiver); target != nil {
+				target.Reply(notice)
 			}
-			fmt.Println("Error accepting connection.")
-			continue
 		}
-		defer conn.Close()
+		return
+	}
 
-		if activeClients >= 8 {
-			denyConn(conn)
-		} else {
-			newClient := initConn(conn, newClientID, &activeClients)
+	response, _ := protocol.EncodeResponse(notice)
+	roomcast(rooms.Of(client), response, client.ID)
+}
 
-			if newClient != nil {
-				fmt.Printf("[%s joined from %s. There are %d users in the room.]\n", newClient.Nickname, newClient.Conn.RemoteAddr(), activeClients)
-				clients = append(clients, newClient)
-				go handleConn(*newClient, &activeClients)
-				newClientID++
-			}
+/* Requests whose Body.Message the server passes on to other users */
+var relayedCodes = map[protocol.RequestCode]bool{
+	protocol.ReqBroadcast: true,
+	protocol.ReqSecret:    true,
+	protocol.ReqExcept:    true,
+	protocol.ReqEdit:      true,
+	protocol.ReqReact:     true,
+	protocol.ReqAnnounce:  true,
+}
+
+/** Return whether the text of request still fits in one frame once relayed, with the longest prefix and suffix the server adds. **/
+func fitsRelayed(client *Client, request protocol.Request) bool {
+	text := fmt.Sprintf("[Announcement from %s] %s (sent 01-02 15:04)", client.Nickname, request.Body.Message)
+	response := protocol.Response{Code: protocol.ResMessage, Message: text, Sender: client.Nickname, ID: math.MaxUint64, Time: math.MaxInt64, Private: true}
+	encoded, err := protocol.EncodeResponse(response)
+	return err == nil && len(encoded) <= protocol.MaxFrameSize
+}
+
+/** Return a random hex token no one can guess. **/
+func newToken() string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+/** Return the response that carries a secret to its receiver. Encrypted bodies are relayed untouched. **/
+func secretResponse(msg offlineMessage, held bool) protocol.Response {
+	var response protocol.Response
+	if msg.Encrypted {
+		response = protocol.NewResponse(protocol.ResEncrypted, msg.Message)
+	} else {
+		text := fmt.Sprintf("from: %s> %s", msg.Sender, msg.Message)
+		if held {
+			text += fmt.Sprintf(" (sent %s)", msg.Sent.Format("01-02 15:04"))
 		}
+		response = protocol.NewResponse(protocol.ResMessage, text)
 	}
+
+	response.Sender = msg.Sender
+	response.ID = msg.ID
+	response.Time = msg.Sent.UnixMilli()
+	response.Private = true
+	return response
 }
 
-/** Initialize connection. **/
-func initConn(conn net.Conn, newClientID int, activeClients *int) *Client {
-	buffer := make([]byte, 1024)
+/** Edit, delete or react to a message if the client may, and tell everyone who saw it. **/
+func changeMessage(client *Client, request protocol.Request) {
+	reply := func(format string, a ...interface{}) {
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf(format, a...)))
+	}
 
-	n, err := conn.Read(buffer)
+	id, err := strconv.ParseUint(strings.TrimPrefix(request.Header.Receiver, "#"), 10, 64)
 	if err != nil {
-		conn.Close()
-		fmt.Println("client disconnected")
-		return nil
+		reply("[invalid message ID: %s]", request.Header.Receiver)
+		return
 	}
-
-	var request Request
-	if err := json.Unmarshal(buffer[:n], &request); err != nil {
-		fmt.Println("Error decoding packet:", err)
-		return nil
+	msg, err := messages.Get(id)
+	seenBy := messages.SeenBy(id)
+	if err != nil || (msg.Sender != client.Nickname && !reaches(msg, seenBy, rooms.Of(client), client.Nickname)) {
+		reply("[no such message: #%d]", id)
+		return
 	}
 
-	if isValidNickname(request.Header.Sender) {
-		*activeClients++
+	// The change keeps the message's audience.
+	change := history.Entry{ID: id, Kind: msg.Kind, Room: msg.Room, Sender: msg.Sender, Author: msg.Author, Receiver: msg.Receiver, Receivers: msg.Receivers, Actor: client.Nickname, Message: request.Body.Message}
+	ownMessage := msg.Author != "" && msg.Author == client.Author
+	var response protocol.Response
 
-		msg := fmt.Sprintf("[Welcome %s to CAU net-class chat room at %s.]\n[There are %d users in the room.]", request.Header.Sender, conn.LocalAddr(), *activeClients)
-		response, _ := json.Marshal(Response{Code: 1, Message: msg})
+	switch request.Header.Code {
+	case protocol.ReqEdit:
+		if !ownMessage {
+			reply("[permission denied: you can only edit your own messages from this session or your registered nickname.]")
+			return
+		} else if msg.Encrypted {
+			reply("[encrypted messages cannot be edited.]")
+			return
+		} else if change.Message == "" {
+			reply("[Please enter the new text.]")
+			return
+		}
+		change.Action = history.ActionEdit
+		response = protocol.NewResponse(protocol.ResEdited, change.Message)
 
-		_, err := conn.Write(response)
-		if err != nil {
-			fmt.Println("Error sending response.")
+	case protocol.ReqDelete:
+		if !ownMessage && !client.Operator {
+			reply("[permission denied: you can only delete your own messages from this session or your registered nickname.]")
+			return
 		}
+		change.Action = history.ActionDelete
+		change.Message = ""
+		response = protocol.NewResponse(protocol.ResDeleted, "")
 
-		return &Client{ID: newClientID, Nickname: request.Header.Sender, Conn: conn}
+	case protocol.ReqReact:
+		if change.Message == "" || utf8.RuneCountInString(change.Message) > reactionLimit || strings.IndexFunc(change.Message, unicode.IsSpace) >= 0 {
+			reply("[invalid reaction: use an emoji or a short word.]")
+			return
+		}
+		change.Action = history.ActionReact
+		response = protocol.NewResponse(protocol.ResReaction, change.Message)
+	}
 
-	} else {
-		msg := "[nickname already used by another user. cannot connect.]"
-		response, _ := json.Marshal(Response{Code: 3, Message: msg})
+	response.ID = id
+	response.Sender = client.Nickname
+	response.Time = time.Now().UnixMilli()
+	response.Private = msg.Kind == history.KindSecret
 
-		_, err := conn.Write(response)
-		if err != nil {
-			fmt.Println("Error sending response.")
+	// A secret not delivered yet is changed where it waits.
+	if msg.Kind == history.KindSecret && change.Action != history.ActionReact {
+		text := change.Message
+		if text != "" {
+			text += " (edited)"
 		}
-		conn.Close()
+		mailbox.Revise(msg.Receiver, id, text)
+	}
 
-		return nil
+	encoded, _ := protocol.EncodeResponse(response)
+	for _, c := range recipients(msg, seenBy) {
+		c.Send(encoded)
 	}
+	record(change)
 }
 
-/** Check for nickname duplication. **/
-func isValidNickname(nickname string) bool {
-	for _, c := range clients {
-		if c.Nickname == nickname {
-			return false
+/** Return whether msg went to nickname, judging by where nickname is now if seenBy is not known. **/
+func reaches(msg history.Entry, seenBy []string, room string, nickname string) bool {
+	if seenBy == nil {
+		return visibleIn(room, nickname)(msg)
+	}
+	return slices.Contains(seenBy, nickname)
+}
+
+/** Return the connected clients a change to msg goes to: those in seenBy, or its audience now if seenBy is not known. **/
+func recipients(msg history.Entry, seenBy []string) []*Client {
+	if seenBy == nil {
+		return audience(msg)
+	}
+
+	var found []*Client
+	for _, nickname := range seenBy {
+		if c := clients.ByNickname(nickname); c != nil && !slices.Contains(found, c) {
+			found = append(found, c)
 		}
 	}
-	return true
+	return found
 }
 
-/** Deny new connection. **/
-func denyConn(conn net.Conn) {
-	message := "chatting room full. cannot connect"
-	response, _ := json.Marshal(Response{Code: 3, Message: message})
+/** Return the connected clients a message goes to, its sender included. **/
+func audience(msg history.Entry) []*Client {
+	var found []*Client
+
+	switch msg.Kind {
+	case history.KindSecret:
+		for _, nickname := range []string{msg.Sender, msg.Receiver} {
+			if c := clients.ByNickname(nickname); c != nil {
+				found = append(found, c)
+			}
+		}
+	case history.KindExcept:
+		for _, c := range rooms.Members(msg.Room) {
+			if !msg.HasReceiver(c.Nickname) {
+				found = append(found, c)
+			}
+		}
+	default:
+		found = rooms.Members(msg.Room)
+	}
+	return found
+}
+
+/** Take a file offer and ask the client to upload the file on a data connection. **/
+func offerFile(client *Client, request protocol.Request) {
+	reply := func(format string, a ...interface{}) {
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf(format, a...)))
+	}
 
-	_, err := conn.Write(response)
+	info := request.Body.File
+	if dataPort == "" {
+		reply("[file transfers are disabled on this server.]")
+		return
+	} else if info == nil || info.Size < 0 || len(info.Hash) != 64 {
+		reply("[invalid file offer.]")
+		return
+	} else if info.Size > maxFileSize {
+		reply("[%s is too large. limit is %s.]", info.Name, filetransfer.FormatSize(maxFileSize))
+		return
+	}
+
+	var receivers []string
+	target := request.Header.Receiver
+	if target == protocol.AllReceivers {
+		for _, c := range rooms.Members(rooms.Of(client)) {
+			if c.ID != client.ID {
+				receivers = append(receivers, c.Nickname)
+			}
+		}
+		if len(receivers) == 0 {
+			reply("[There is no one else in the room.]")
+			return
+		}
+	} else if c := clients.ByNickname(target); c == nil {
+		reply("[no such user: %s]", target)
+		return
+	} else if c.ID == client.ID {
+		reply("[You cannot send a file to yourself.]")
+		return
+	} else {
+		receivers = []string{target}
+	}
+
+	offered := *info
+	offered.Name = filetransfer.CleanName(info.Name)
+	offered = transfers.Offer(client.Nickname, offered, receivers)
+
+	response := protocol.NewResponse(protocol.ResUpload, "")
+	response.File = &offered
+	response.DataPort = dataPort
+	client.Reply(response)
+}
+
+/** Refuse file transfer id and tell its sender. **/
+func declineFile(client *Client, id string) {
+	found, err := transfers.Finish(id, client.Nickname)
 	if err != nil {
-		fmt.Println("Error sending response.")
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[no such file offer: %s]", id)))
+		return
+	}
+
+	client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[declined %s.]", found.Info.Name)))
+	if sender := clients.ByNickname(found.Sender); sender != nil {
+		sender.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[%s declined %s.]", client.Nickname, found.Info.Name)))
 	}
-	conn.Close()
 }
 
-/** Check if the message contains "i hate professor". **/
-func containsIHateProf(msg string) bool {
-	lowercaseMsg := strings.ToLower(msg)
-	return strings.Contains(lowercaseMsg, "i hate professor")
+/** Return a per-target error telling the sender why target was skipped. **/
+func targetError(target string, reason string) protocol.Response {
+	response := protocol.NewResponse(protocol.ResTargetError, reason)
+	response.Target = target
+	return response
 }
 
-/** Handle each connection. **/
-func handleConn(client Client, activeClients *int) {
-	defer client.Conn.Close()
+/** Turn targets into nicknames, expanding the client's groups. Reports unknown groups and returns whether all were found. **/
+func resolveTargets(client *Client, targets []string) ([]string, bool) {
+	var nicknames []string
+	ok := true
 
-	for {
-		buffer := make([]byte, 1024)
+	for _, target := range targets {
+		if !strings.HasPrefix(target, protocol.GroupPrefix) {
+			nicknames = addNames(nicknames, []string{target})
+			continue
+		}
 
-		n, _ := client.Conn.Read(buffer)
+		members, err := groups.Members(client.Nickname, strings.TrimPrefix(target, protocol.GroupPrefix))
+		if err != nil {
+			client.Reply(targetError(target, fmt.Sprintf("[no such group: %s]", target)))
+			ok = false
+			continue
+		}
+		for _, member := range members {
+			if member != client.Nickname { // groups may list their owner
+				nicknames = addNames(nicknames, []string{member})
+			}
+		}
+	}
 
-		var request Request
-		_ = json.Unmarshal(buffer[:n], &request)
+	if len(targets) == 0 {
+		client.Reply(protocol.NewResponse(protocol.ResReply, "[Please enter a nickname or a group.]"))
+		ok = false
+	}
+	return nicknames, ok
+}
 
-		requestCode := request.Header.Code
+/** Turn targets into nicknames without reporting anything. **/
+func expandGroups(client *Client, targets []string) []string {
+	var nicknames []string
+	for _, target := range targets {
+		if !strings.HasPrefix(target, protocol.GroupPrefix) {
+			nicknames = addNames(nicknames, []string{target})
+		} else if members, err := groups.Members(client.Nickname, strings.TrimPrefix(target, protocol.GroupPrefix)); err == nil {
+			nicknames = addNames(nicknames, members)
+		}
+	}
+	return nicknames
+}
 
-		if requestCode == 1 { // default (send to all)
-			msg := fmt.Sprintf("%s> %s", client.Nickname, request.Body.Message)
-			response, _ := json.Marshal(Response{Code: 2, Message: msg})
-			go broadcast(response, client.ID)
+/** Carry out a \group command on the client's own groups. **/
+func manageGroup(client *Client, request protocol.Request) {
+	reply := func(format string, a ...interface{}) {
+		client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf(format, a...)))
+	}
 
-		} else if requestCode == 2 { // \ls
-			var info strings.Builder
-			for _, c := range clients {
-				addr := c.Conn.RemoteAddr().(*net.TCPAddr)
-				info.WriteString(fmt.Sprintf("<%s, %s, %d>\n", c.Nickname, addr.IP, addr.Port))
-			}
-			response, _ := json.Marshal(Response{Code: 2, Message: info.String()})
-			client.Conn.Write(response)
+	action := request.Body.Message
+	name := strings.TrimPrefix(request.Header.Receiver, protocol.GroupPrefix)
+	members := request.Header.Receivers
 
-		} else if requestCode == 3 { // \secret
-			msg := fmt.Sprintf("from: %s> %s", request.Header.Sender, request.Body.Message)
-			response, _ := json.Marshal(Response{Code: 2, Message: msg})
-			secret(response, request.Header.Receiver)
+	if action != protocol.GroupList && !isValidGroupName(name) {
+		reply("[invalid group name: %s]", request.Header.Receiver)
+		return
+	}
 
-		} else if requestCode == 4 { // \except
-			msg := fmt.Sprintf("%s> %s", request.Header.Sender, request.Body.Message)
-			response, _ := json.Marshal(Response{Code: 2, Message: msg})
-			except(response, client.Nickname, request.Header.Receiver)
+	var err error
+	switch action {
+	case protocol.GroupCreate:
+		if err = groups.Create(client.Nickname, name, members); err == nil {
+			reply("[created group @%s: %s]", name, strings.Join(members, ", "))
+		}
 
-		} else if requestCode == 5 { // \ping
-			response, _ := json.Marshal(Response{Code: 0, Message: ""})
-			_, err := client.Conn.Write(response)
+	case protocol.GroupAdd, protocol.GroupRemove:
+		var current []string
+		if action == protocol.GroupAdd {
+			current, err = groups.Add(client.Nickname, name, members)
+		} else {
+			current, err = groups.Remove(client.Nickname, name, members)
+		}
+		if err == nil {
+			reply("[@%s: %s]", name, strings.Join(current, ", "))
+		}
 
-			if err != nil {
-				fmt.Println("Error sending response.")
-			}
+	case protocol.GroupDelete:
+		if err = groups.Delete(client.Nickname, name); err == nil {
+			reply("[deleted group @%s.]", name)
+		}
 
-		} else if requestCode == 6 { // \quit
-			removeClient(&client, activeClients)
-			break
+	case protocol.GroupShow:
+		var current []string
+		if current, err = groups.Members(client.Nickname, name); err == nil {
+			response := protocol.NewResponse(protocol.ResGroup, "")
+			response.Target = protocol.GroupPrefix + name
+			response.Members = current
+			client.Reply(response)
+		}
 
+	case protocol.GroupList:
+		names := groups.Names(client.Nickname)
+		if len(names) == 0 {
+			reply("[You have no groups.]")
 		} else {
-			msg := fmt.Sprintf("invalid command: %s", request.Body.Message)
-			response, _ := json.Marshal(Response{Code: 3, Message: msg})
-			client.Conn.Write(response)
+			reply("[your groups: @%s]", strings.Join(names, ", @"))
 		}
 
-		if containsIHateProf(request.Body.Message) {
-			// Response to sender that it has been kicked out.
-			response, _ := json.Marshal(Response{Code: 3, Message: "[You are kicked out of the chat room.]"})
-			client.Conn.Write(response)
-			client.Conn.Close()
+	default:
+		reply("[invalid group command: %s]", action)
+	}
 
-			// Remove the sender
-			go removeClient(&client, activeClients)
-			break
+	if err == errNoSuchGroup {
+		client.Reply(targetError(protocol.GroupPrefix+name, fmt.Sprintf("[no such group: @%s]", name)))
+	} else if err == errGroupExists {
+		reply("[group @%s already exists.]", name)
+	} else if err == errTooManyGroups {
+		reply("[You already have %d groups.]", groupLimit)
+	} else if err == errGroupFull {
+		reply("[a group can have at most %d members.]", groupSize)
+	}
+}
+
+/** Group names are letters, digits, "-" and "_", 32 characters or less. **/
+func isValidGroupName(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return false
 		}
 	}
+	return true
 }
 
-/** Broadcast message **/
-func broadcast(msg []byte, senderID int) {
-	for _, client := range clients {
-		if client.ID != senderID {
-			_, err := client.Conn.Write(msg)
-			if err != nil {
-				fmt.Println("Error sending message to client:", err)
-			}
+/** Send except message to the sender's room, leaving out excluded nicknames. **/
+func except(msg []byte, sender *Client, excluded []string) {
+	for _, client := range rooms.Members(rooms.Of(sender)) {
+		if client.ID != sender.ID && !containsName(excluded, client.Nickname) {
+			client.Send(msg)
 		}
 	}
 }
 
-/** Send secret message. **/
-func secret(msg []byte, receiver string) {
-	for _, client := range clients {
-		if client.Nickname == receiver {
-			_, err := client.Conn.Write(msg)
-			if err != nil {
-				fmt.Println("Error sending message to client:", err)
-			}
+/** Create a room and move the client into it. **/
+func createRoom(client *Client, name string, limit string) {
+	if name == "" {
+		client.Reply(protocol.NewResponse(protocol.ResReply, "[Please enter a room name.]"))
+		return
+	} else if !protocol.ValidRoomName(name) {
+		client.Reply(failure(protocol.ReasonRoomName, fmt.Sprintf("[invalid room name: English letters, digits, '-' and '_' only, %d or less.]", protocol.MaxRoomNameLength)))
+		return
+	}
+
+	capacity := 0
+	if limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 {
+			client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[invalid room limit: %s]", limit)))
+			return
 		}
+		capacity = n
+	}
+
+	if err := rooms.Create(name, capacity); err != nil {
+		client.Reply(failure(protocol.ReasonRoomExists, fmt.Sprintf("[room %s already exists.]", name)))
+		return
 	}
+	fmt.Printf("[%s created room %s.]\n", client.Nickname, name)
+	joinRoom(client, name)
 }
 
-/** Send except message. **/
-func except(msg []byte, sender string, receiver string) {
-	for _, client := range clients {
-		if client.Nickname != sender && client.Nickname != receiver {
-			_, err := client.Conn.Write(msg)
-			if err != nil {
-				fmt.Println("Error sending message to client:", err)
+/** Move the client to another room and tell both rooms. **/
+func joinRoom(client *Client, name string) {
+	from := rooms.Of(client)
+
+	count, err := rooms.Join(client, name)
+	if err == errNoSuchRoom {
+		client.Reply(failure(protocol.ReasonNoSuchRoom, fmt.Sprintf("[no such room: %s]", name)))
+		return
+	} else if err == errAlreadyInRoom {
+		client.Reply(failure(protocol.ReasonInRoom, fmt.Sprintf("[You are already in %s.]", name)))
+		return
+	} else if err == errRoomFull {
+		client.Reply(failure(protocol.ReasonFull, fmt.Sprintf("[%s is full. cannot join.]", name)))
+		return
+	}
+
+	left := fmt.Sprintf("[%s left the room. There are %d users now.]", client.Nickname, len(rooms.Members(from)))
+	response, _ := protocol.EncodeResponse(roomEvent(protocol.ResMessage, left, protocol.EventLeave, client.Nickname, from))
+	roomcast(from, response, client.ID)
+	record(history.Entry{Kind: history.KindSystem, Room: from, Message: left})
+
+	joined := fmt.Sprintf("[%s joined the room. There are %d users now.]", client.Nickname, count)
+	response, _ = protocol.EncodeResponse(roomEvent(protocol.ResMessage, joined, protocol.EventJoin, client.Nickname, name))
+	roomcast(name, response, client.ID)
+	record(history.Entry{Kind: history.KindSystem, Room: name, Message: joined})
+
+	client.Reply(roomEvent(protocol.ResReply, fmt.Sprintf("[You are now in %s. There are %d users in the room.]", name, count), protocol.EventJoin, client.Nickname, name))
+}
+
+/** Return a notice that nickname came into or left room. **/
+func roomEvent(code protocol.ResponseCode, message string, event string, nickname string, room string) protocol.Response {
+	response := protocol.NewResponse(code, message)
+	response.Event = event
+	response.Sender = nickname
+	response.Target = room
+	return response
+}
+
+/** Return the reply to a request that did not go through. **/
+func failure(reason string, message string) protocol.Response {
+	response := protocol.NewResponse(protocol.ResReply, message)
+	response.Reason = reason
+	return response
+}
+
+/** Remove a client whose connection was lost, keeping its session for a resume. **/
+func dropClient(client *Client) {
+	room := rooms.Of(client)
+	removeClient(client)
+	sessions.Away(client.Session, client.ID, room)
+}
+
+/** Disconnect client and remove it from the registry **/
+func removeClient(client *Client) {
+	_, ok := clients.Remove(client.ID)
+	if !ok {
+		return
+	}
+	room, activeClients := rooms.Remove(client)
+
+	msg := fmt.Sprintf("[%s left the room. There are %d users now.]", client.Nickname, activeClients)
+	fmt.Println(msg)
+	response, _ := protocol.EncodeResponse(roomEvent(protocol.ResMessage, msg, protocol.EventQuit, client.Nickname, room))
+	roomcast(room, response, client.ID)
+	record(history.Entry{Kind: history.KindSystem, Room: room, Message: msg})
+}
+
+/** Append entry to the chat history if it is enabled. **/
+func record(entry history.Entry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.ID == 0 {
+		sessions.Missed(entry, nil)
+	} else if entry.Action == "" {
+		// Changes to the message later go to these nicknames only.
+		seenBy := []string{}
+		if entry.Kind == history.KindSecret { // held ones reach the receiver later
+			seenBy = append(seenBy, entry.Sender, entry.Receiver)
+		} else {
+			for _, c := range audience(entry) {
+				seenBy = append(seenBy, c.Nickname)
 			}
 		}
+		seenBy = append(seenBy, sessions.Missed(entry, nil)...)
+		messages.Apply(entry, seenBy)
+	} else {
+		sessions.Missed(entry, messages.SeenBy(entry.ID))
+		messages.Apply(entry, nil)
+	}
+
+	if chatLog == nil {
+		return
+	}
+	if err := chatLog.Append(entry); err != nil {
+		fmt.Println("Error writing history:", err)
 	}
 }
 
-/** Disconnect client and remove it from clients array **/
-func removeClient(client *Client, activeClients *int) {
-	msg := fmt.Sprintf("[%s left the room. There are %d users now.]", client.Nickname, *activeClients-1)
-	fmt.Println(msg)
-	response, _ := json.Marshal(Response{Code: 2, Message: msg})
-	go broadcast(response, client.ID)
+/** Return whether client may see entry: its room's messages and its own secrets. **/
+func visibleTo(client *Client) func(history.Entry) bool {
+	return visibleIn(rooms.Of(client), client.Nickname)
+}
 
-	for i, c := range clients {
-		if c.ID == client.ID {
-			clients = append(clients[:i], clients[i+1:]...)
-			*activeClients--
-			break
+/** Return whether nickname in room may see entry. **/
+func visibleIn(room string, nickname string) func(history.Entry) bool {
+	return func(entry history.Entry) bool {
+		switch entry.Kind {
+		case history.KindSecret:
+			return entry.Sender == nickname || entry.Receiver == nickname
+		case history.KindExcept:
+			return entry.Room == room && !entry.HasReceiver(nickname)
+		default:
+			return entry.Room == room
+		}
+	}
+}
+
+/** Write the most recent messages straight to a client that just joined. **/
+func replayHistory(client *Client) {
+	if chatLog == nil || replayCount < 1 {
+		return
+	}
+
+	// Secrets are left to deliverHeld so nothing shows up twice.
+	visible := visibleTo(client)
+	entries := chatLog.Recent(replayCount, func(entry history.Entry) bool {
+		return entry.Kind != history.KindSecret && visible(entry)
+	})
+	if len(entries) == 0 {
+		return
+	}
+
+	writeEntries(client, fmt.Sprintf("[last %d messages]", len(entries)), entries)
+}
+
+/** Write heading, then each entry in a frame of its own, straight to the client. Long messages can't add up past the frame limit that way. **/
+func writeEntries(client *Client, heading string, entries []history.Entry) {
+	lines := []string{heading}
+	for _, entry := range entries {
+		lines = append(lines, entry.String())
+	}
+
+	for _, line := range lines {
+		err := protocol.WriteResponse(client.Conn, protocol.NewResponse(protocol.ResMessage, line))
+		if err == protocol.ErrFrameTooLarge {
+			continue // nothing was written, only this one is left out
+		} else if err != nil {
+			fmt.Println("Error sending response.")
+			writeErrors.Inc()
+			return
+		}
+	}
+}
+
+/** Write what a resumed client missed while it was away straight to it. **/
+func sendMissed(client *Client, missed []history.Entry) {
+	if len(missed) == 0 {
+		return
+	}
+
+	writeEntries(client, fmt.Sprintf("[%d messages while you were away]", len(missed)), missed)
+}
+
+/** Write secret messages held while the client was away straight to it. **/
+func deliverHeld(client *Client) {
+	mailbox.Seen(client.Nickname)
+
+	for _, held := range mailbox.Take(client.Nickname) {
+		err := protocol.WriteResponse(client.Conn, secretResponse(held, true))
+		if err != nil {
+			fmt.Println("Error sending response.")
+			writeErrors.Inc()
+			return
+		}
+
+		receipts.Track(held.ID, held.Sender, client.Nickname)
+		if sender := clients.ByNickname(held.Sender); sender != nil {
+			sender.Reply(receipt(held.ID, client.Nickname, protocol.ReceiptDelivered))
+		}
+	}
+}
+
+/** Reply with one page of older messages. **/
+func sendHistory(client *Client, page string) {
+	if chatLog == nil {
+		client.Reply(protocol.NewResponse(protocol.ResReply, "[history is disabled on this server.]"))
+		return
+	}
+
+	n := 1
+	if page != "" {
+		var err error
+		n, err = strconv.Atoi(page)
+		if err != nil || n < 1 {
+			client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[invalid page: %s]", page)))
+			return
 		}
 	}
+
+	entries := chatLog.Page(n, historyPageSize, visibleTo(client))
+	if len(entries) == 0 {
+		client.Reply(protocol.NewResponse(protocol.ResReply, "[no more history.]"))
+		return
+	}
+
+	// One reply per entry, so a page of long messages can't add up past the frame limit.
+	client.Reply(protocol.NewResponse(protocol.ResReply, fmt.Sprintf("[history page %d]", n)))
+	for _, entry := range entries {
+		client.Reply(protocol.NewResponse(protocol.ResReply, entry.String()))
+	}
 }
@@ -0,0 +1,141 @@
+/** accounts.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package accounts
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	saltSize   = 16
+	keySize    = 32
+	iterations = 210000
+)
+
+var ErrRegistered = errors.New("nickname already registered")
+var ErrEmptyPassword = errors.New("empty password")
+
+type Account struct {
+	Salt       []byte    `json:"salt"`
+	Hash       []byte    `json:"hash"`
+	Iterations int       `json:"iterations"`
+	Created    time.Time `json:"created"`
+}
+
+/** Registered nicknames stored as a JSON file, safe for concurrent use. **/
+type Store struct {
+	mu       sync.Mutex
+	path     string
+	accounts map[string]Account
+}
+
+/** Open the account file at path. A missing file is an empty store. **/
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, accounts: make(map[string]Account)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &s.accounts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+/** Return whether nickname is registered. **/
+func (s *Store) Registered(nickname string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.accounts[nickname]
+	return ok
+}
+
+/** Register nickname with password and save the store. **/
+func (s *Store) Register(nickname string, password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	hash, err := deriveKey(password, salt, iterations, keySize)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[nickname]; ok {
+		return ErrRegistered
+	}
+	s.accounts[nickname] = Account{Salt: salt, Hash: hash, Iterations: iterations, Created: time.Now()}
+
+	if err := s.save(); err != nil {
+		delete(s.accounts, nickname)
+		return err
+	}
+	return nil
+}
+
+/** Return whether password matches the registered nickname. **/
+func (s *Store) Verify(nickname string, password string) bool {
+	s.mu.Lock()
+	account, ok := s.accounts[nickname]
+	s.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	hash, err := deriveKey(password, account.Salt, account.Iterations, len(account.Hash))
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(hash, account.Hash) == 1
+}
+
+/** Caller must hold s.mu. Write the file through a temporary so a crash can't truncate it. **/
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(s.accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+/** PBKDF2 with HMAC-SHA256 (RFC 8018). **/
+func deriveKey(password string, salt []byte, iter int, keyLen int) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, password, salt, iter, keyLen)
+}
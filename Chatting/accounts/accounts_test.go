@@ -0,0 +1,134 @@
+/** accounts_test.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package accounts
+
+import (
+	"bytes"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+/** PBKDF2-HMAC-SHA256 vectors from RFC 7914 section 11, and the RFC 6070 inputs run with SHA-256. **/
+func TestDeriveKeyVectors(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		iter     int
+		want     string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+		{"password", "salt", 1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{"password", "salt", 2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{"password", "salt", 4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+		{"passwordPASSWORDpassword", "saltSALTsaltSALTsaltSALTsaltSALTsalt", 4096, "348c89dbcbd32b2f32d814b8116e84cf2b17347ebc1800181c4e2a1fb8dd53e1c635518c7dac47e9"},
+		{"pass\x00word", "sa\x00lt", 4096, "89b69d0516f829893c696226650a8687"},
+	}
+
+	for _, test := range tests {
+		want, _ := hex.DecodeString(test.want)
+		got, err := deriveKey(test.password, []byte(test.salt), test.iter, len(want))
+		if err != nil {
+			t.Fatalf("deriveKey(%q, %q, %d): %v", test.password, test.salt, test.iter, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("deriveKey(%q, %q, %d) = %x, want %s", test.password, test.salt, test.iter, got, test.want)
+		}
+	}
+}
+
+/** Passwords are stored as salted hashes, never as themselves. **/
+func TestRegisterHashes(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	if err := s.Register("alice", "secret"); err != nil {
+		t.Fatalf("Register alice: %v", err)
+	}
+	if err := s.Register("bob", "secret"); err != nil {
+		t.Fatalf("Register bob: %v", err)
+	}
+	if err := s.Register("alice", "other"); err != ErrRegistered {
+		t.Errorf("second alice: got %v, want ErrRegistered", err)
+	}
+	if err := s.Register("carol", ""); err != ErrEmptyPassword {
+		t.Errorf("empty password: got %v, want ErrEmptyPassword", err)
+	}
+
+	alice, bob := s.accounts["alice"], s.accounts["bob"]
+	if len(alice.Salt) != saltSize || len(alice.Hash) != keySize || alice.Iterations != iterations {
+		t.Errorf("alice: got %d-byte salt, %d-byte hash, %d iterations", len(alice.Salt), len(alice.Hash), alice.Iterations)
+	}
+	if bytes.Contains(alice.Hash, []byte("secret")) {
+		t.Error("password stored in the clear")
+	}
+	if bytes.Equal(alice.Salt, bob.Salt) || bytes.Equal(alice.Hash, bob.Hash) {
+		t.Error("same password gave two accounts the same salt or hash")
+	}
+
+	want, _ := deriveKey("secret", alice.Salt, alice.Iterations, keySize)
+	if !bytes.Equal(alice.Hash, want) {
+		t.Error("stored hash isn't PBKDF2 of the password and salt")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "accounts.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := s.Register("alice", "secret"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+
+	if !s.Verify("alice", "secret") {
+		t.Error("right password refused")
+	}
+	if s.Verify("alice", "Secret") || s.Verify("alice", "secret ") || s.Verify("alice", "") {
+		t.Error("wrong password accepted")
+	}
+	if s.Verify("bob", "secret") {
+		t.Error("unregistered nickname accepted")
+	}
+
+	reopened, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if !reopened.Registered("alice") || !reopened.Verify("alice", "secret") {
+		t.Error("account lost after reopening")
+	}
+}
+
+/** The whole hash is compared: a difference in any byte, or a hash of another length, is refused. **/
+func TestVerifyComparesWholeHash(t *testing.T) {
+	s, err := Open(filepath.Join(t.TempDir(), "accounts.json"))
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	if err := s.Register("alice", "secret"); err != nil {
+		t.Fatalf("Register: %v", err)
+	}
+	account := s.accounts["alice"]
+
+	for _, i := range []int{0, keySize / 2, keySize - 1} {
+		tampered := account
+		tampered.Hash = bytes.Clone(account.Hash)
+		tampered.Hash[i] ^= 1
+		s.accounts["alice"] = tampered
+		if s.Verify("alice", "secret") {
+			t.Errorf("hash with byte %d changed still verified", i)
+		}
+	}
+
+	s.accounts["alice"] = account
+	if !s.Verify("alice", "secret") {
+		t.Error("untouched hash refused")
+	}
+}
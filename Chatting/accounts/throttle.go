@@ -0,0 +1,84 @@
+/** throttle.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package accounts
+
+import (
+	"sync"
+	"time"
+)
+
+/* After FreeAttempts failures, each further attempt has to wait twice as long as the last, up to MaxDelay. */
+type Throttle struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	Forget       time.Duration // failures older than this are forgotten
+
+	mu       sync.Mutex
+	failures map[string]*failure
+}
+
+type failure struct {
+	count int
+	last  time.Time
+}
+
+func NewThrottle() *Throttle {
+	return &Throttle{
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		Forget:       15 * time.Minute,
+		failures:     make(map[string]*failure),
+	}
+}
+
+/** Return how long to wait before key may try again, or 0. **/
+func (t *Throttle) Wait(key string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	if !ok {
+		return 0
+	}
+	if time.Since(f.last) > t.Forget {
+		delete(t.failures, key)
+		return 0
+	}
+	if f.count < t.FreeAttempts {
+		return 0
+	}
+
+	delay := t.BaseDelay << uint(f.count-t.FreeAttempts)
+	if delay > t.MaxDelay || delay <= 0 {
+		delay = t.MaxDelay
+	}
+	if wait := time.Until(f.last.Add(delay)); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+/** Count a failed attempt for key. **/
+func (t *Throttle) Fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	f, ok := t.failures[key]
+	if !ok {
+		f = &failure{}
+		t.failures[key] = f
+	}
+	f.count++
+	f.last = time.Now()
+}
+
+/** Forget failures for key after it got in. **/
+func (t *Throttle) Succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+}
@@ -0,0 +1,308 @@
+/** client.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/young-jin-son/Network-Practice/Chatting/protocol"
+)
+
+var ErrRefused = errors.New("server refused the connection")
+var ErrShuttingDown = errors.New("server is shutting down")
+var ErrClosed = errors.New("client closed")
+
+// How long Close waits for the server to hang up after ReqQuit.
+const closeTimeout = 2 * time.Second
+
+/* Connection settings *
+ * ServerTimeout: treat the connection as dead after this long without a frame (the server sends heartbeats)
+ * Reconnect: redial with backoff when the connection drops, resuming the session
+ * OnReconnecting: called before each attempt with the error that ended the connection (attempt 1) or the last attempt
+ * OnReconnected: called with the server's welcome once the session is resumed */
+type Config struct {
+	Server   string
+	Port     string
+	Nickname string
+
+	Password         string
+	OperatorPassword string
+	PublicKey        string // published for end-to-end encrypted secrets
+	TLS              *tls.Config
+
+	ServerTimeout time.Duration
+	Reconnect     bool
+	MaxBackoff    time.Duration
+
+	OnReconnecting func(attempt int, err error)
+	OnReconnected  func(welcome protocol.Response)
+}
+
+/** A connection to the chat server for programs like bots, safe for concurrent use. **/
+type Client struct {
+	config Config
+
+	mu      sync.RWMutex
+	conn    net.Conn
+	session string
+
+	responses chan protocol.Response
+	stop      chan struct{}
+	done      chan struct{}
+	closing   atomic.Bool
+	kicked    atomic.Bool // the server kicked or banned us; coming back would only be refused again
+	err       error
+}
+
+/** Connect and join the chat. Returns the client and the server's welcome reply. **/
+func Dial(config Config) (*Client, protocol.Response, error) {
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = 30 * time.Second
+	}
+
+	c := &Client{
+		config:    config,
+		responses: make(chan protocol.Response, 64),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	welcome, err := c.connect()
+	if err != nil {
+		return nil, welcome, err
+	}
+	go c.run()
+	return c, welcome, nil
+}
+
+/** Send the connect request on conn and return the server's reply, an error if it turned us away. **/
+func Connect(conn net.Conn, request protocol.Request, timeout time.Duration) (protocol.Response, error) {
+	if err := protocol.WriteRequest(conn, request); err != nil {
+		return protocol.Response{}, err
+	}
+
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	response, err := protocol.ReadResponse(conn)
+	if err != nil {
+		return response, err
+	}
+
+	if response.Code == protocol.ResError {
+		return response, fmt.Errorf("%w: %s", ErrRefused, response.Message)
+	} else if response.Code == protocol.ResTerminated {
+		return response, ErrShuttingDown
+	}
+	return response, nil
+}
+
+/** Return whether response ends the session for good: a kick, a ban or a refused password.
+ * Other errors, like being dropped for not responding, are worth reconnecting after. **/
+func Final(response protocol.Response) bool {
+	if response.Code != protocol.ResError {
+		return false
+	}
+	return response.Reason == protocol.ReasonKicked || response.Reason == protocol.ReasonBanned || response.Reason == protocol.ReasonPassword
+}
+
+/** Return incoming responses. Heartbeats are answered and left out. Closed when the client stops for good. **/
+func (c *Client) Responses() <-chan protocol.Response {
+	return c.responses
+}
+
+/** Call handle with each incoming response until the client stops, and return why it stopped. **/
+func (c *Client) Handle(handle func(protocol.Response)) error {
+	for response := range c.responses {
+		handle(response)
+	}
+	return c.Err()
+}
+
+/** Return why the client stopped, once Responses is closed. **/
+func (c *Client) Err() error {
+	<-c.done
+	return c.err
+}
+
+/** Return the nickname the client joined with. **/
+func (c *Client) Nickname() string {
+	return c.config.Nickname
+}
+
+/** Send request, filling in our nickname as the sender. **/
+func (c *Client) Send(request protocol.Request) error {
+	if request.Header.Sender == "" {
+		request.Header.Sender = c.config.Nickname
+	}
+	return protocol.WriteRequest(c.current(), request)
+}
+
+/** Say message to the room. **/
+func (c *Client) Say(message string) error {
+	return c.Send(protocol.NewRequest(protocol.ReqBroadcast, c.config.Nickname, "", message))
+}
+
+/** Send message to targets only: nicknames, or groups starting with protocol.GroupPrefix. **/
+func (c *Client) Secret(message string, targets ...string) error {
+	request := protocol.NewRequest(protocol.ReqSecret, c.config.Nickname, "", message)
+	request.Header.Receivers = targets
+	return c.Send(request)
+}
+
+/** Say message to the room except targets. **/
+func (c *Client) Except(message string, targets ...string) error {
+	request := protocol.NewRequest(protocol.ReqExcept, c.config.Nickname, "", message)
+	request.Header.Receivers = targets
+	return c.Send(request)
+}
+
+/** Move to room. **/
+func (c *Client) Join(room string) error {
+	return c.Send(protocol.NewRequest(protocol.ReqJoinRoom, c.config.Nickname, room, ""))
+}
+
+/** Leave the chat and stop the client. Responses to earlier requests are still handed out while the server says goodbye. **/
+func (c *Client) Close() error {
+	if c.closing.Swap(true) {
+		<-c.done
+		return nil
+	}
+
+	err := c.Send(protocol.NewRequest(protocol.ReqQuit, c.config.Nickname, "", ""))
+	select {
+	case <-c.done:
+	case <-time.After(closeTimeout):
+	}
+
+	close(c.stop)
+	c.current().Close()
+	<-c.done
+	return err
+}
+
+func (c *Client) current() net.Conn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.conn
+}
+
+/** Dial and join, resuming our session if we have one. **/
+func (c *Client) connect() (protocol.Response, error) {
+	address := net.JoinHostPort(c.config.Server, c.config.Port)
+
+	var conn net.Conn
+	var err error
+	if c.config.TLS != nil {
+		conn, err = tls.Dial("tcp", address, c.config.TLS)
+	} else {
+		conn, err = net.Dial("tcp", address)
+	}
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	c.mu.RLock()
+	request := protocol.NewRequest(protocol.ReqConnect, c.config.Nickname, "", "")
+	request.Body.Password = c.config.Password
+	request.Body.OperatorPassword = c.config.OperatorPassword
+	request.Body.PublicKey = c.config.PublicKey
+	request.Body.Session = c.session
+	c.mu.RUnlock()
+
+	welcome, err := Connect(conn, request, c.config.ServerTimeout)
+	if err != nil {
+		conn.Close()
+		return welcome, err
+	}
+
+	c.mu.Lock()
+	c.conn = conn
+	c.session = welcome.Session
+	c.mu.Unlock()
+	return welcome, nil
+}
+
+/** Read responses and hand them out until the connection ends for good. **/
+func (c *Client) run() {
+	defer close(c.done)
+	defer close(c.responses)
+
+	for {
+		conn := c.current()
+		if c.config.ServerTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(c.config.ServerTimeout))
+		}
+
+		// An oversized frame leaves the stream out of sync; it ends the connection like any other error.
+		response, err := protocol.ReadResponse(conn)
+		if err != nil && c.closing.Load() {
+			c.err = ErrClosed
+			return
+		} else if err != nil && c.config.Reconnect && !c.kicked.Load() {
+			conn.Close()
+			if err = c.reconnect(err); err == nil {
+				continue
+			}
+			c.err = err
+			return
+		} else if err != nil {
+			c.err = err
+			return
+		}
+
+		if response.Code == protocol.ResRTT && response.Message == protocol.Heartbeat {
+			c.Send(protocol.NewRequest(protocol.ReqPing, c.config.Nickname, "", protocol.Heartbeat))
+			continue
+		} else if Final(response) {
+			c.kicked.Store(true)
+		}
+
+		select {
+		case c.responses <- response:
+		case <-c.stop:
+		}
+	}
+}
+
+/** Redial with exponential backoff and full jitter until the handshake succeeds, the server refuses us or the client is closed. **/
+func (c *Client) reconnect(cause error) error {
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		if c.config.OnReconnecting != nil {
+			c.config.OnReconnecting(attempt, cause)
+		}
+
+		// Full jitter keeps clients dropped together from all coming back at once.
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(backoff)) + 1)):
+		case <-c.stop:
+			return ErrClosed
+		}
+
+		welcome, err := c.connect()
+		if err == nil {
+			if c.config.OnReconnected != nil {
+				c.config.OnReconnected(welcome)
+			}
+			return nil
+		} else if errors.Is(err, ErrRefused) {
+			return err
+		}
+		cause = err
+
+		backoff *= 2
+		if backoff > c.config.MaxBackoff {
+			backoff = c.config.MaxBackoff
+		}
+	}
+}
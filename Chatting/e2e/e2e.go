@@ -0,0 +1,227 @@
+/** e2e.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package e2e
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const version = "chat-e2e-v1"
+
+var ErrBadKey = errors.New("malformed public key")
+var ErrBadEnvelope = errors.New("malformed encrypted message")
+var ErrBadSignature = errors.New("signature does not match sender's key")
+
+/** A client's long-term keys: X25519 to receive, Ed25519 to sign. **/
+type Identity struct {
+	exchange *ecdh.PrivateKey
+	signing  ed25519.PrivateKey
+}
+
+/** Public half of an Identity. **/
+type PublicKey struct {
+	Exchange *ecdh.PublicKey
+	Signing  ed25519.PublicKey
+}
+
+type identityFile struct {
+	Exchange []byte `json:"exchange"`
+	Signing  []byte `json:"signing"`
+}
+
+/** Create a new identity. **/
+func Generate() (*Identity, error) {
+	exchange, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, signing, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{exchange: exchange, signing: signing}, nil
+}
+
+/** Load the identity at path, creating and saving a new one if it doesn't exist. **/
+func LoadOrCreate(path string) (*Identity, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := Generate()
+		if err != nil {
+			return nil, err
+		}
+		data, _ := json.Marshal(identityFile{Exchange: id.exchange.Bytes(), Signing: id.signing.Seed()})
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		return id, os.WriteFile(path, data, 0600)
+	} else if err != nil {
+		return nil, err
+	}
+
+	var file identityFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	exchange, err := ecdh.X25519().NewPrivateKey(file.Exchange)
+	if err != nil {
+		return nil, err
+	}
+	if len(file.Signing) != ed25519.SeedSize {
+		return nil, ErrBadKey
+	}
+	return &Identity{exchange: exchange, signing: ed25519.NewKeyFromSeed(file.Signing)}, nil
+}
+
+/** Return the public key to publish. **/
+func (id *Identity) Public() PublicKey {
+	return PublicKey{Exchange: id.exchange.PublicKey(), Signing: id.signing.Public().(ed25519.PublicKey)}
+}
+
+/** Return the key as "<exchange>.<signing>" in base64. **/
+func (k PublicKey) String() string {
+	return base64.StdEncoding.EncodeToString(k.Exchange.Bytes()) + "." + base64.StdEncoding.EncodeToString(k.Signing)
+}
+
+/** Return a short fingerprint for people to compare. **/
+func (k PublicKey) Fingerprint() string {
+	sum := sha256.Sum256([]byte(k.String()))
+	return base64.RawStdEncoding.EncodeToString(sum[:12])
+}
+
+/** Parse a key made by PublicKey.String. **/
+func ParsePublicKey(s string) (PublicKey, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 2 {
+		return PublicKey{}, ErrBadKey
+	}
+
+	exchangeBytes, err := base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return PublicKey{}, ErrBadKey
+	}
+	exchange, err := ecdh.X25519().NewPublicKey(exchangeBytes)
+	if err != nil {
+		return PublicKey{}, ErrBadKey
+	}
+
+	signing, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(signing) != ed25519.PublicKeySize {
+		return PublicKey{}, ErrBadKey
+	}
+
+	return PublicKey{Exchange: exchange, Signing: ed25519.PublicKey(signing)}, nil
+}
+
+type envelope struct {
+	Ephemeral  []byte `json:"eph"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ct"`
+	Signature  []byte `json:"sig"`
+}
+
+/** Encrypt plaintext for recipient and sign it as sender. Returns a string safe to relay. **/
+func Seal(sender *Identity, senderNick string, recipient PublicKey, recipientNick string, plaintext string) (string, error) {
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	shared, err := ephemeral.ECDH(recipient.Exchange)
+	if err != nil {
+		return "", err
+	}
+
+	aead, err := newAEAD(shared, ephemeral.PublicKey().Bytes(), recipient.Exchange.Bytes())
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	env := envelope{Ephemeral: ephemeral.PublicKey().Bytes(), Nonce: nonce}
+	env.Ciphertext = aead.Seal(nil, nonce, []byte(plaintext), []byte(senderNick+"\x00"+recipientNick))
+	env.Signature = ed25519.Sign(sender.signing, signedData(senderNick, recipientNick, env))
+
+	data, err := json.Marshal(env)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+/** Verify sealed came from sender and decrypt it. **/
+func Open(recipient *Identity, recipientNick string, sender PublicKey, senderNick string, sealed string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", ErrBadEnvelope
+	}
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return "", ErrBadEnvelope
+	}
+
+	if !ed25519.Verify(sender.Signing, signedData(senderNick, recipientNick, env), env.Signature) {
+		return "", ErrBadSignature
+	}
+
+	ephemeral, err := ecdh.X25519().NewPublicKey(env.Ephemeral)
+	if err != nil {
+		return "", ErrBadEnvelope
+	}
+	shared, err := recipient.exchange.ECDH(ephemeral)
+	if err != nil {
+		return "", ErrBadEnvelope
+	}
+
+	aead, err := newAEAD(shared, env.Ephemeral, recipient.exchange.PublicKey().Bytes())
+	if err != nil {
+		return "", err
+	}
+	if len(env.Nonce) != aead.NonceSize() {
+		return "", ErrBadEnvelope
+	}
+	plaintext, err := aead.Open(nil, env.Nonce, env.Ciphertext, []byte(senderNick+"\x00"+recipientNick))
+	if err != nil {
+		return "", ErrBadEnvelope
+	}
+	return string(plaintext), nil
+}
+
+func newAEAD(shared []byte, ephemeral []byte, recipient []byte) (cipher.AEAD, error) {
+	h := sha256.New()
+	h.Write([]byte(version))
+	h.Write(shared)
+	h.Write(ephemeral)
+	h.Write(recipient)
+
+	block, err := aes.NewCipher(h.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func signedData(senderNick string, recipientNick string, env envelope) []byte {
+	var data []byte
+	for _, part := range [][]byte{[]byte(version), []byte(senderNick), []byte(recipientNick), env.Ephemeral, env.Nonce, env.Ciphertext} {
+		data = binary.BigEndian.AppendUint32(data, uint32(len(part)))
+		data = append(data, part...)
+	}
+	return data
+}
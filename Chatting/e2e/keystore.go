@@ -0,0 +1,96 @@
+/** keystore.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package e2e
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/* Trust result */
+type Trust int
+
+const (
+	TrustNew     Trust = iota // first time we see this nickname; key saved
+	TrustKnown                // matches the saved key
+	TrustChanged              // differs from the saved key; not saved
+)
+
+/** Trust-on-first-use store of peers' public keys, kept in a JSON file. **/
+type KeyStore struct {
+	mu   sync.Mutex
+	path string
+	keys map[string]string
+}
+
+/** Open the key store at path. A missing file is an empty store. **/
+func OpenKeyStore(path string) (*KeyStore, error) {
+	ks := &KeyStore{path: path, keys: make(map[string]string)}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ks, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &ks.keys); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+/** Compare key with what we know about nickname, remembering it if it is new. **/
+func (ks *KeyStore) Check(nickname string, key PublicKey) (Trust, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	known, ok := ks.keys[nickname]
+	if !ok {
+		ks.keys[nickname] = key.String()
+		return TrustNew, ks.save()
+	}
+	if known != key.String() {
+		return TrustChanged, nil
+	}
+	return TrustKnown, nil
+}
+
+/** Return the saved key for nickname. **/
+func (ks *KeyStore) Get(nickname string) (PublicKey, bool) {
+	ks.mu.Lock()
+	known, ok := ks.keys[nickname]
+	ks.mu.Unlock()
+
+	if !ok {
+		return PublicKey{}, false
+	}
+	key, err := ParsePublicKey(known)
+	return key, err == nil
+}
+
+/** Replace the saved key for nickname, after the user has checked the change. **/
+func (ks *KeyStore) Trust(nickname string, key PublicKey) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	ks.keys[nickname] = key.String()
+	return ks.save()
+}
+
+/** Caller must hold ks.mu. **/
+func (ks *KeyStore) save() error {
+	data, err := json.MarshalIndent(ks.keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ks.path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(ks.path, data, 0600)
+}
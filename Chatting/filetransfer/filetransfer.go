@@ -0,0 +1,111 @@
+/** filetransfer.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package filetransfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const chunkSize = 32 * 1024
+
+var ErrHashMismatch = errors.New("file hash does not match")
+
+/** Called as bytes go by, with how many have been copied so far out of total. **/
+type Progress func(done int64, total int64)
+
+/** Return the SHA-256 in hex and the size of the file at path. **/
+func Hash(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+/** Copy exactly size bytes from src to dst in chunks and check they hash to want. **/
+func Copy(dst io.Writer, src io.Reader, size int64, want string, progress Progress) error {
+	h := sha256.New()
+	buffer := make([]byte, chunkSize)
+
+	var done int64
+	for done < size {
+		chunk := buffer
+		if left := size - done; left < int64(len(chunk)) {
+			chunk = chunk[:left]
+		}
+
+		n, err := io.ReadFull(src, chunk)
+		if n > 0 {
+			h.Write(chunk[:n])
+			if _, werr := dst.Write(chunk[:n]); werr != nil {
+				return werr
+			}
+			done += int64(n)
+			if progress != nil {
+				progress(done, size)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != want {
+		return ErrHashMismatch
+	}
+	return nil
+}
+
+/** Return a name safe to save a received file under: no directories, nothing hidden. **/
+func CleanName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.TrimLeft(name, ".")
+	if name == "" || name == "/" {
+		name = "file"
+	}
+	return name
+}
+
+/** Return a path in dir for name that is not taken yet, adding " (n)" before the extension if needed. **/
+func FreePath(dir string, name string) string {
+	path := filepath.Join(dir, name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+
+	for n := 1; ; n++ {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", base, n, ext))
+	}
+}
+
+/** Return size in a form people read, like "1.5 MB". **/
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
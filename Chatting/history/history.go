@@ -0,0 +1,264 @@
+/** history.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package history
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/* Entry Kind */
+const (
+	KindBroadcast = "broadcast"
+	KindSecret    = "secret"
+	KindExcept    = "except"
+	KindSystem    = "system"
+)
+
+/* Entry Action, for changes to the chat message with the entry's ID */
+const (
+	ActionEdit   = "edit"
+	ActionDelete = "delete"
+	ActionReact  = "react"
+)
+
+type Entry struct {
+	ID        uint64    `json:"id,omitempty"` // chat messages only
+	Time      time.Time `json:"time"`
+	Kind      string    `json:"kind"`
+	Room      string    `json:"room,omitempty"`
+	Sender    string    `json:"sender,omitempty"`
+	Receiver  string    `json:"receiver,omitempty"`
+	Receivers []string  `json:"receivers,omitempty"` // excepts that left out several nicknames
+	Message   string    `json:"message"`
+	Encrypted bool      `json:"encrypted,omitempty"`
+
+	// Set when the entry changes message ID instead of being one. Kind, Room and
+	// Receiver are copied from the message so the change has the same audience.
+	Action string `json:"action,omitempty"`
+	Actor  string `json:"actor,omitempty"`
+
+	// Who may change the message: an account, or a session for nicknames that aren't registered.
+	Author string `json:"author,omitempty"`
+
+	// Set on messages returned by Page whose text was replaced by a later edit.
+	Edited bool `json:"-"`
+}
+
+// How many of the newest entries are kept in memory for Page and Recent; older ones are only in the file. 0 keeps all.
+var Window = 10000
+
+/** Append-only chat log stored as one JSON entry per line. **/
+type Log struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries []Entry
+	lastID  uint64
+}
+
+/** Open the log at path, creating it if needed and loading what is already there.
+ * A last line left without its newline by a crash is completed if it is whole, cut off if not. **/
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{file: file}
+
+	reader := bufio.NewReader(file)
+	var size int64 // up to the end of the last complete line
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == nil {
+			size += int64(len(line))
+			l.load(line)
+			continue
+		} else if err == io.EOF && len(line) > 0 {
+			err = l.repair(line, size)
+		} else if err == io.EOF {
+			err = nil
+		}
+
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return l, nil
+	}
+}
+
+/** Add a line read by Open, skipping one that isn't an entry. **/
+func (l *Log) load(line []byte) {
+	var entry Entry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return // skip a line torn by a crash
+	}
+	l.add(entry)
+}
+
+/** Finish the last line, which has no newline, so the next Append starts a line of its own. **/
+func (l *Log) repair(line []byte, size int64) error {
+	var entry Entry
+	if json.Unmarshal(line, &entry) == nil {
+		if _, err := l.file.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+		l.add(entry)
+		return nil
+	}
+	return l.file.Truncate(size)
+}
+
+/** Caller must hold l.mu, or be Open. Keep entry in the window, dropping the oldest in batches so appending stays cheap. **/
+func (l *Log) add(entry Entry) {
+	if entry.ID > l.lastID {
+		l.lastID = entry.ID
+	}
+
+	l.entries = append(l.entries, entry)
+	if Window > 0 && len(l.entries) > Window+Window/4 {
+		l.entries = append([]Entry(nil), l.entries[len(l.entries)-Window:]...)
+	}
+}
+
+/** Write entry to disk, stamping it with the current time if unset. **/
+func (l *Log) Append(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.add(entry)
+	return nil
+}
+
+/** Return the n most recent entries that visible accepts, oldest first. **/
+func (l *Log) Recent(n int, visible func(Entry) bool) []Entry {
+	return l.Page(1, n, visible)
+}
+
+/** Return the highest message ID in the log, so IDs keep growing across restarts. **/
+func (l *Log) LastID() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lastID
+}
+
+/** Return page (1 = newest) of size n among the entries visible accepts, oldest first.
+ * Messages come as they are now: deleted ones are left out and edited ones carry their newest text. **/
+func (l *Log) Page(page int, n int, visible func(Entry) bool) []Entry {
+	if page < 1 || n < 1 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Changes are logged after their message, so walking back sees them first.
+	deleted := make(map[uint64]bool)
+	edited := make(map[uint64]string)
+
+	skip := (page - 1) * n
+	var found []Entry
+	for i := len(l.entries) - 1; i >= 0 && len(found) < n; i-- {
+		entry := l.entries[i]
+		if entry.Action == ActionDelete {
+			deleted[entry.ID] = true
+			continue
+		} else if entry.Action == ActionEdit {
+			if _, ok := edited[entry.ID]; !ok {
+				edited[entry.ID] = entry.Message
+			}
+			continue
+		}
+
+		if deleted[entry.ID] || !visible(entry) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		if text, ok := edited[entry.ID]; ok && entry.Action == "" {
+			entry.Message = text
+			entry.Edited = true
+		}
+		found = append(found, entry)
+	}
+
+	// Collected newest first.
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found
+}
+
+/** Return whether nickname is the entry's receiver or one of its receivers. **/
+func (e Entry) HasReceiver(nickname string) bool {
+	if e.Receiver == nickname {
+		return true
+	}
+	for _, receiver := range e.Receivers {
+		if receiver == nickname {
+			return true
+		}
+	}
+	return false
+}
+
+/** Close the underlying file. **/
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+/** Return the entry the way clients display it. **/
+func (e Entry) String() string {
+	stamp := e.Time.Format("01-02 15:04")
+
+	switch e.Action {
+	case ActionEdit:
+		return fmt.Sprintf("[%s] %s edited #%d> %s", stamp, e.Actor, e.ID, e.Message)
+	case ActionDelete:
+		return fmt.Sprintf("[%s] %s deleted #%d", stamp, e.Actor, e.ID)
+	case ActionReact:
+		return fmt.Sprintf("[%s] %s reacted %s to #%d", stamp, e.Actor, e.Message, e.ID)
+	}
+
+	if e.ID != 0 {
+		stamp += fmt.Sprintf("] [#%d", e.ID)
+	}
+
+	message := e.Message
+	if e.Edited {
+		message += " (edited)"
+	}
+
+	switch e.Kind {
+	case KindSecret:
+		return fmt.Sprintf("[%s] from: %s to: %s> %s", stamp, e.Sender, e.Receiver, message)
+	case KindSystem:
+		return fmt.Sprintf("[%s] %s", stamp, message)
+	default:
+		return fmt.Sprintf("[%s] %s> %s", stamp, e.Sender, message)
+	}
+}
@@ -0,0 +1,160 @@
+/** history_test.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package history
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/** Open the log at path, new or written by an earlier Log, and close it when the test ends. **/
+func openLog(t *testing.T, path string) *Log {
+	t.Helper()
+	l, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func all(Entry) bool { return true }
+
+/** Pages show messages as they are now, not the edits and deletes that changed them. **/
+func TestPageAppliesChanges(t *testing.T) {
+	l := openLog(t, filepath.Join(t.TempDir(), "chat_history.log"))
+
+	entries := []Entry{
+		{ID: 1, Kind: KindBroadcast, Sender: "alice", Message: "one"},
+		{ID: 2, Kind: KindBroadcast, Sender: "alice", Message: "two"},
+		{ID: 3, Kind: KindBroadcast, Sender: "bob", Message: "three"},
+		{ID: 1, Kind: KindBroadcast, Sender: "alice", Actor: "alice", Action: ActionEdit, Message: "first"},
+		{ID: 2, Kind: KindBroadcast, Sender: "alice", Actor: "bob", Action: ActionReact, Message: "ok"},
+		{ID: 1, Kind: KindBroadcast, Sender: "alice", Actor: "alice", Action: ActionEdit, Message: "1st"},
+		{ID: 2, Kind: KindBroadcast, Sender: "alice", Actor: "alice", Action: ActionDelete},
+		{Kind: KindSystem, Message: "[bob left the room.]"},
+	}
+	for _, entry := range entries {
+		if err := l.Append(entry); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	got := l.Recent(10, all)
+	if len(got) != 3 {
+		t.Fatalf("got %d entries, want 3: %v", len(got), got)
+	}
+	if got[0].ID != 1 || got[0].Message != "1st" || !got[0].Edited {
+		t.Errorf("edited message: got %+v, want #1 with its newest text", got[0])
+	}
+	if got[1].ID != 3 || got[1].Edited {
+		t.Errorf("untouched message: got %+v, want #3 unchanged", got[1])
+	}
+	if got[2].Kind != KindSystem {
+		t.Errorf("got %+v, want the system message last", got[2])
+	}
+
+	// Changes don't take up room on a page.
+	if page := l.Page(1, 2, all); len(page) != 2 || page[0].ID != 3 {
+		t.Errorf("page 1 of 2: got %v", page)
+	}
+	if page := l.Page(2, 2, all); len(page) != 1 || page[0].ID != 1 {
+		t.Errorf("page 2 of 2: got %v", page)
+	}
+}
+
+func TestPageReopened(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat_history.log")
+	l := openLog(t, path)
+	l.Append(Entry{ID: 1, Kind: KindBroadcast, Sender: "alice", Message: "one"})
+	l.Append(Entry{ID: 1, Kind: KindBroadcast, Sender: "alice", Action: ActionEdit, Message: "uno"})
+	l.Close()
+
+	reopened := openLog(t, path)
+
+	got := reopened.Recent(10, all)
+	if len(got) != 1 || got[0].Message != "uno" {
+		t.Errorf("got %v, want the edited message", got)
+	}
+	if reopened.LastID() != 1 {
+		t.Errorf("LastID: got %d, want 1", reopened.LastID())
+	}
+}
+
+/** A crash can leave the last line without its newline. Open finishes it, or cuts it off if it is only part of an entry. **/
+func TestOpenRepairsLastLine(t *testing.T) {
+	tests := []struct {
+		name string
+		tail string
+		want []string
+	}{
+		{"torn entry", `{"id":2,"time":"2024-01-02T00:00:00Z","kind":"broadcast","mess`, []string{"one", "three"}},
+		{"whole entry", `{"id":2,"time":"2024-01-02T00:00:00Z","kind":"broadcast","message":"two"}`, []string{"one", "two", "three"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "chat_history.log")
+			first := `{"id":1,"time":"2024-01-01T00:00:00Z","kind":"broadcast","message":"one"}` + "\n"
+			if err := os.WriteFile(path, []byte(first+test.tail), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			l := openLog(t, path)
+			if err := l.Append(Entry{ID: 3, Kind: KindBroadcast, Message: "three"}); err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+			l.Close()
+
+			data, _ := os.ReadFile(path)
+			if !strings.HasSuffix(string(data), "\n") || strings.Count(string(data), "\n") != len(test.want) {
+				t.Errorf("file not one entry per line:\n%s", data)
+			}
+
+			reopened := openLog(t, path)
+
+			var got []string
+			for _, entry := range reopened.Recent(10, all) {
+				got = append(got, entry.Message)
+			}
+			if strings.Join(got, ",") != strings.Join(test.want, ",") {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+/** Only the newest entries stay in memory, but message IDs keep counting from the whole file. **/
+func TestWindow(t *testing.T) {
+	defer func(window int) { Window = window }(Window)
+	Window = 8
+
+	path := filepath.Join(t.TempDir(), "chat_history.log")
+	l := openLog(t, path)
+	for id := uint64(1); id <= 50; id++ {
+		if err := l.Append(Entry{ID: id, Kind: KindBroadcast, Message: "hi"}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+		if len(l.entries) > Window+Window/4 {
+			t.Fatalf("%d entries in memory after %d appends, window is %d", len(l.entries), id, Window)
+		}
+	}
+
+	got := l.Recent(100, all)
+	if len(got) < Window || got[len(got)-1].ID != 50 {
+		t.Errorf("got %d recent entries ending at #%d, want at least %d ending at #50", len(got), got[len(got)-1].ID, Window)
+	}
+	l.Close()
+
+	reopened := openLog(t, path)
+	if len(reopened.entries) > Window+Window/4 {
+		t.Errorf("%d entries loaded, window is %d", len(reopened.entries), Window)
+	}
+	if reopened.LastID() != 50 {
+		t.Errorf("LastID: got %d, want 50", reopened.LastID())
+	}
+}
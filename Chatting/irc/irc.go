@@ -0,0 +1,446 @@
+/** irc.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package irc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/young-jin-son/Network-Practice/Chatting/protocol"
+)
+
+// Name the gateway gives itself in replies, and the host part of every user's prefix.
+var ServerName = "chatserver"
+
+// IRC lines are 512 bytes; longer ones are allowed for clients that send message tags, up to this.
+const maxLine = 8192
+
+// Longest a write to the client may take. Writes hold mu, so a client that stops reading
+// must not hold up the server's writer or the gateway's reader for longer.
+var writeTimeout = 10 * time.Second
+
+var errQuit = errors.New("irc client quit")
+
+/** Listener turning every connection it accepts into an IRC gateway. **/
+type Listener struct {
+	net.Listener
+}
+
+/** Return a listener whose connections speak IRC to the client and chat frames to the server. **/
+func Listen(inner net.Listener) *Listener {
+	return &Listener{Listener: inner}
+}
+
+/** Wait for the next IRC client. **/
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn), nil
+}
+
+/* IRC gateway connection *
+ * Reads IRC commands from the client and hands them to the server as request frames,
+ * and turns the response frames the server writes into IRC replies, so the server can
+ * treat an IRC client like any other connection. Channels are the server's rooms. */
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	readBuf []byte // rest of the request frames made from the last line
+
+	mu       sync.Mutex // guards the state below and writes to conn
+	writeBuf []byte     // start of a frame not fully written yet
+
+	nickname   string
+	user       string
+	password   string
+	connecting bool // ReqConnect sent
+	welcomed   bool
+	room       string
+
+	joining string      // last room asked for with JOIN, for error numerics
+	quiet   int         // failed create or join replies expected from JOIN, not shown
+	lists   []listQuery // what each ReqList sent was for, answered in order
+	pings   []string    // tokens of PINGs from the client waiting for their RTT reply
+}
+
+/** What a ReqList was sent for: NAMES, WHO or LIST, and its argument. **/
+type listQuery struct {
+	command string
+	mask    string
+}
+
+/** One IRC message. **/
+type message struct {
+	command string
+	params  []string
+}
+
+/** Wrap conn, a connection from an IRC client. **/
+func NewConn(conn net.Conn) *Conn {
+	return &Conn{conn: conn, reader: bufio.NewReaderSize(conn, maxLine)}
+}
+
+/** Read IRC lines until one makes a request, and return the requests as length-prefixed frames. **/
+func (c *Conn) Read(p []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		line, err := c.readLine()
+		if err != nil {
+			return 0, err
+		}
+
+		msg, ok := parse(line)
+		if !ok {
+			continue
+		}
+
+		c.mu.Lock()
+		requests, err := c.handle(msg)
+		c.mu.Unlock()
+
+		for _, request := range requests {
+			payload, _ := protocol.EncodeRequest(request)
+			frame := make([]byte, protocol.FrameHeaderSize+len(payload))
+			binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+			copy(frame[protocol.FrameHeaderSize:], payload)
+			c.readBuf = append(c.readBuf, frame...)
+		}
+		if err != nil && len(c.readBuf) == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+/** Turn every complete response frame in p into IRC replies, keeping any partial one for the next Write. **/
+func (c *Conn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeBuf = append(c.writeBuf, p...)
+	for len(c.writeBuf) >= protocol.FrameHeaderSize {
+		size := int(binary.BigEndian.Uint32(c.writeBuf))
+		if len(c.writeBuf) < protocol.FrameHeaderSize+size {
+			break
+		}
+		response, err := protocol.DecodeResponse(c.writeBuf[protocol.FrameHeaderSize : protocol.FrameHeaderSize+size])
+		c.writeBuf = c.writeBuf[protocol.FrameHeaderSize+size:]
+		if err != nil {
+			continue
+		}
+		if err := c.send(c.reply(response)...); err != nil {
+			c.writeBuf = nil
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+/** Read one line without its line ending, skipping lines longer than maxLine. **/
+func (c *Conn) readLine() (string, error) {
+	for {
+		line, err := c.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			for err == bufio.ErrBufferFull {
+				_, err = c.reader.ReadSlice('\n')
+			}
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(line), "\r\n"), nil
+	}
+}
+
+/** Split a line into its command and parameters, dropping message tags and the prefix. **/
+func parse(line string) (message, bool) {
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	line = strings.TrimLeft(line, " ")
+	if strings.HasPrefix(line, ":") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+
+	var msg message
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		if strings.HasPrefix(line, ":") && msg.command != "" {
+			msg.params = append(msg.params, line[1:])
+			break
+		}
+
+		var word string
+		word, line, _ = strings.Cut(line, " ")
+		if word == "" {
+			continue
+		} else if msg.command == "" {
+			msg.command = strings.ToUpper(word)
+		} else {
+			msg.params = append(msg.params, word)
+		}
+	}
+	return msg, msg.command != ""
+}
+
+/** Act on a command from the client: answer it directly, or return the requests that carry it to the server. Called with mu held. **/
+func (c *Conn) handle(msg message) ([]protocol.Request, error) {
+	param := func(i int) string {
+		if i < len(msg.params) {
+			return msg.params[i]
+		}
+		return ""
+	}
+
+	// Registration, answered here until the server has the connect request.
+	if msg.command == "CAP" {
+		sub := strings.ToUpper(param(0))
+		if sub == "LS" || sub == "LIST" {
+			c.send("CAP * " + sub + " :")
+		} else if sub == "REQ" {
+			c.send("CAP * NAK :" + param(1))
+		}
+		return nil, nil
+	} else if msg.command == "PASS" {
+		c.password = param(0)
+		return nil, nil
+	} else if msg.command == "NICK" && c.connecting {
+		c.numeric("432", param(0), "Nicknames can't be changed here; reconnect with the new one.")
+		return nil, nil
+	} else if msg.command == "NICK" && param(0) == "" {
+		c.numeric("431", "No nickname given")
+		return nil, nil
+	} else if msg.command == "NICK" && !protocol.ValidNickname(param(0)) {
+		c.numeric("432", param(0), fmt.Sprintf("Erroneous nickname: English letters only, %d or less", protocol.MaxNicknameLength))
+		return nil, nil
+	} else if msg.command == "NICK" || msg.command == "USER" {
+		if msg.command == "NICK" {
+			c.nickname = param(0)
+		} else if len(msg.params) < 4 {
+			c.numeric("461", "USER", "Not enough parameters")
+			return nil, nil
+		} else {
+			c.user = param(0)
+		}
+		if c.nickname == "" || c.user == "" || c.connecting {
+			return nil, nil
+		}
+
+		// Join like ChatClient, then fill in NAMES for the channel the welcome puts us in.
+		c.connecting = true
+		request := c.request(protocol.ReqConnect, "", "")
+		request.Body.Password = c.password
+		c.lists = append(c.lists, listQuery{command: "NAMES"})
+		return []protocol.Request{request, c.request(protocol.ReqList, "", "")}, nil
+	} else if msg.command == "QUIT" {
+		c.send("ERROR :Closing link")
+		if !c.connecting {
+			return nil, errQuit
+		}
+		return []protocol.Request{c.request(protocol.ReqQuit, "", "")}, errQuit
+	} else if msg.command == "PING" && !c.connecting {
+		c.send(":" + ServerName + " PONG " + ServerName + " :" + param(0))
+		return nil, nil
+	} else if !c.connecting {
+		c.numeric("451", "You have not registered")
+		return nil, nil
+	}
+
+	if msg.command == "PING" {
+		c.pings = append(c.pings, param(0))
+		return []protocol.Request{c.request(protocol.ReqPing, "", "")}, nil
+
+	} else if msg.command == "PONG" { // heartbeat reply
+		return []protocol.Request{c.request(protocol.ReqPing, "", protocol.Heartbeat)}, nil
+
+	} else if msg.command == "PRIVMSG" || msg.command == "NOTICE" {
+		if param(0) == "" {
+			c.numeric("411", "No recipient given ("+msg.command+")")
+			return nil, nil
+		} else if param(1) == "" {
+			c.numeric("412", "No text to send")
+			return nil, nil
+		}
+
+		text := param(1)
+		if strings.HasPrefix(text, "\x01ACTION ") {
+			text = "* " + strings.TrimSuffix(strings.TrimPrefix(text, "\x01ACTION "), "\x01")
+		} else if strings.HasPrefix(text, "\x01") { // other CTCP, like VERSION
+			return nil, nil
+		}
+
+		var requests []protocol.Request
+		var nicknames []string
+		for _, target := range strings.Split(param(0), ",") {
+			if target == "" {
+				continue
+			} else if !isChannel(target) {
+				nicknames = append(nicknames, target)
+			} else if channelRoom(target) == c.room {
+				requests = append(requests, c.request(protocol.ReqBroadcast, "", text))
+			} else if msg.command == "PRIVMSG" {
+				c.numeric("404", target, "Cannot send to channel; JOIN it first")
+			}
+		}
+		if len(nicknames) > 0 {
+			request := c.request(protocol.ReqSecret, "", text)
+			request.Header.Receivers = nicknames
+			requests = append(requests, request)
+		}
+		return requests, nil
+
+	} else if msg.command == "JOIN" && param(0) == "0" {
+		return c.leave(), nil
+
+	} else if msg.command == "JOIN" {
+		channels := strings.Split(param(0), ",")
+		for _, extra := range channels[1:] {
+			c.numeric("405", extra, "You can only be in one channel at a time")
+		}
+		room := channelRoom(channels[0])
+		if !isChannel(channels[0]) || room == "" {
+			c.numeric("403", channels[0], "No such channel")
+			return nil, nil
+		} else if !protocol.ValidRoomName(room) {
+			c.numeric("479", channels[0], "Illegal channel name")
+			return nil, nil
+		} else if room == c.room {
+			return nil, nil
+		}
+
+		// Create the room in case it is new, then join it. One of the two fails quietly.
+		c.joining = room
+		c.quiet++
+		c.lists = append(c.lists, listQuery{command: "NAMES", mask: channels[0]})
+		return []protocol.Request{
+			c.request(protocol.ReqCreateRoom, room, ""),
+			c.request(protocol.ReqJoinRoom, room, ""),
+			c.request(protocol.ReqList, "", ""),
+		}, nil
+
+	} else if msg.command == "PART" {
+		if channelRoom(param(0)) != c.room {
+			c.numeric("442", param(0), "You're not on that channel")
+			return nil, nil
+		}
+		return c.leave(), nil
+
+	} else if msg.command == "NAMES" || msg.command == "WHO" || msg.command == "LIST" {
+		c.lists = append(c.lists, listQuery{command: msg.command, mask: param(0)})
+		return []protocol.Request{c.request(protocol.ReqList, "", "")}, nil
+
+	} else if msg.command == "KICK" {
+		if param(1) == "" {
+			c.numeric("461", "KICK", "Not enough parameters")
+			return nil, nil
+		}
+		return []protocol.Request{c.request(protocol.ReqKick, param(1), param(2))}, nil
+
+	} else if msg.command == "MODE" && isChannel(param(0)) {
+		c.numeric("324", param(0), "+")
+		return nil, nil
+
+	} else if msg.command == "MODE" {
+		c.numeric("221", "+")
+		return nil, nil
+
+	} else if msg.command == "TOPIC" {
+		c.numeric("331", param(0), "No topic is set")
+		return nil, nil
+
+	} else {
+		c.numeric("421", msg.command, "Unknown command")
+		return nil, nil
+	}
+}
+
+/** Return the requests that take us back to the lobby and list who is there. Called with mu held. **/
+func (c *Conn) leave() []protocol.Request {
+	c.lists = append(c.lists, listQuery{command: "NAMES"})
+	return []protocol.Request{c.request(protocol.ReqLeaveRoom, "", ""), c.request(protocol.ReqList, "", "")}
+}
+
+/** Return a request from our nickname. **/
+func (c *Conn) request(code protocol.RequestCode, receiver string, text string) protocol.Request {
+	return protocol.NewRequest(code, c.nickname, receiver, text)
+}
+
+/** Send a numeric reply to the client. Called with mu held. **/
+func (c *Conn) numeric(code string, params ...string) {
+	c.send(c.numericLine(code, params...))
+}
+
+/** Write lines to the client. Called with mu held. **/
+func (c *Conn) send(lines ...string) error {
+	if len(lines) == 0 {
+		return nil
+	}
+
+	var out strings.Builder
+	for _, line := range lines {
+		out.WriteString(clean(line))
+		out.WriteString("\r\n")
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	_, err := c.conn.Write([]byte(out.String()))
+	return err
+}
+
+/** Return s with CR and LF turned into spaces and NUL dropped, so it can't end a line or start another. **/
+func clean(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		} else if r == 0 {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+/** Report whether target names a channel. **/
+func isChannel(target string) bool {
+	return strings.HasPrefix(target, "#") || strings.HasPrefix(target, "&")
+}
+
+/** Return the room a channel stands for. **/
+func channelRoom(channel string) string {
+	return strings.TrimLeft(channel, "#&")
+}
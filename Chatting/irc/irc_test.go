@@ -0,0 +1,94 @@
+/** irc_test.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package irc
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/young-jin-son/Network-Practice/Chatting/protocol"
+)
+
+/** Return a gateway on one end of a pipe and a reader of what it sends on the other. **/
+func pipe(t *testing.T) (*Conn, *bufio.Reader) {
+	t.Helper()
+	gateway, client := net.Pipe()
+	t.Cleanup(func() {
+		gateway.Close()
+		client.Close()
+	})
+	return NewConn(gateway), bufio.NewReader(client)
+}
+
+func TestNickValidated(t *testing.T) {
+	tests := []string{"bad nick", "a,b", "bob2", strings.Repeat("a", protocol.MaxNicknameLength+1)}
+
+	for _, nickname := range tests {
+		c, client := pipe(t)
+		done := make(chan []protocol.Request)
+		go func() {
+			c.mu.Lock()
+			requests, _ := c.handle(message{command: "NICK", params: []string{nickname}})
+			c.handle(message{command: "USER", params: []string{"u", "0", "*", "real"}})
+			c.mu.Unlock()
+			done <- requests
+		}()
+
+		line, err := client.ReadString('\n')
+		if err != nil {
+			t.Fatalf("%q: %v", nickname, err)
+		}
+		if !strings.Contains(line, " 432 ") {
+			t.Errorf("%q: got %q, want 432", nickname, line)
+		}
+		if requests := <-done; len(requests) != 0 || c.nickname != "" {
+			t.Errorf("%q: nickname taken anyway", nickname)
+		}
+	}
+}
+
+/** Text from other users can't end the line it is relayed in and start a command of its own. **/
+func TestRelayedTextCleaned(t *testing.T) {
+	c := &Conn{nickname: "alice", welcomed: true, room: "lobby"}
+
+	responses := []protocol.Response{
+		{Code: protocol.ResMessage, ID: 1, Sender: "bob", Message: "bob> hi\r:evil KICK #lobby alice\x00"},
+		{Code: protocol.ResMessage, ID: 2, Sender: "bob", Private: true, Message: "from: bob> one\r\ntwo\nthree"},
+		{Code: protocol.ResReply, Message: "[notice]\r\x00QUIT :bye"},
+		{Code: protocol.ResEdited, ID: 1, Sender: "bob\r\nQUIT", Message: "x"},
+	}
+
+	for _, response := range responses {
+		for _, line := range c.reply(response) {
+			if strings.ContainsAny(line, "\r\n\x00") {
+				t.Errorf("line %q still has a line break or NUL", line)
+			}
+		}
+	}
+
+	lines := c.reply(responses[1])
+	if len(lines) != 3 || !strings.HasSuffix(lines[1], "PRIVMSG alice :two") {
+		t.Errorf("multi-line secret: got %q", lines)
+	}
+}
+
+func TestSendCleansLines(t *testing.T) {
+	c, client := pipe(t)
+	go func() {
+		c.mu.Lock()
+		c.send("NOTICE alice :one\r\nQUIT :two\x00")
+		c.mu.Unlock()
+	}()
+
+	line, err := client.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "NOTICE alice :one  QUIT :two\r\n" {
+		t.Errorf("got %q", line)
+	}
+}
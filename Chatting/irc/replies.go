@@ -0,0 +1,265 @@
+/** replies.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package irc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/young-jin-son/Network-Practice/Chatting/filetransfer"
+	"github.com/young-jin-son/Network-Practice/Chatting/protocol"
+)
+
+/** Return the IRC lines that carry response to the client. Called with mu held. **/
+func (c *Conn) reply(response protocol.Response) []string {
+	if !c.welcomed {
+		return c.welcome(response)
+	}
+
+	if response.Code == protocol.ResRTT && response.Message == protocol.Heartbeat { // server checking we're alive
+		return []string{"PING :" + ServerName}
+
+	} else if response.Code == protocol.ResRTT { // answer to a PING
+		token := ServerName
+		if len(c.pings) > 0 {
+			token = c.pings[0]
+			c.pings = c.pings[1:]
+		}
+		return []string{":" + ServerName + " PONG " + ServerName + " :" + token}
+
+	} else if response.Code == protocol.ResMessage && response.ID != 0 { // chat message
+		if response.Private {
+			text := strings.TrimPrefix(response.Message, "from: "+response.Sender+"> ")
+			return c.fromUser(response.Sender, "PRIVMSG", c.nickname, text)
+		}
+		text := strings.TrimPrefix(response.Message, response.Sender+"> ")
+		return c.fromUser(response.Sender, "PRIVMSG", "#"+c.room, text)
+
+	} else if response.Code == protocol.ResMessage && response.Members != nil { // \ls
+		if len(c.lists) == 0 {
+			return c.notice(response.Message)
+		}
+		query := c.lists[0]
+		c.lists = c.lists[1:]
+		return c.listReply(query, response)
+
+	} else if response.Event != "" && response.Sender == c.nickname { // we moved
+		var lines []string
+		if c.room != "" && c.room != response.Target {
+			lines = append(lines, c.prefix(c.nickname)+" PART #"+c.room)
+		}
+		c.room = response.Target
+		lines = append(lines, c.prefix(c.nickname)+" JOIN #"+c.room)
+		return append(lines, c.numericLine("331", "#"+c.room, "No topic is set"))
+
+	} else if response.Event == protocol.EventJoin {
+		return []string{c.prefix(response.Sender) + " JOIN #" + response.Target}
+
+	} else if response.Event == protocol.EventLeave {
+		return []string{c.prefix(response.Sender) + " PART #" + response.Target}
+
+	} else if response.Event == protocol.EventQuit {
+		return []string{c.prefix(response.Sender) + " QUIT :Quit"}
+
+	} else if response.Code == protocol.ResError && response.Reason == protocol.ReasonKicked {
+		by := ServerName
+		if response.Sender != "" {
+			by = response.Sender
+		}
+		return []string{
+			c.prefix(by) + " KICK #" + c.room + " " + c.nickname + " :" + response.Message,
+			"ERROR :" + response.Message,
+		}
+
+	} else if response.Code == protocol.ResError || response.Code == protocol.ResTerminated {
+		return []string{"ERROR :" + response.Message}
+
+	} else if (response.Reason == protocol.ReasonRoomExists || response.Reason == protocol.ReasonInRoom) && c.quiet > 0 {
+		c.quiet--
+		return nil
+
+	} else if response.Reason == protocol.ReasonFull && c.joining != "" {
+		return []string{c.numericLine("471", "#"+c.joining, response.Message)}
+
+	} else if response.Reason == protocol.ReasonNoSuchRoom && c.joining != "" {
+		return []string{c.numericLine("403", "#"+c.joining, response.Message)}
+
+	} else if response.Code == protocol.ResTargetError {
+		return []string{c.numericLine("401", response.Target, response.Message)}
+
+	} else if response.Code == protocol.ResEncrypted {
+		return c.fromUser(response.Sender, "NOTICE", c.nickname, "[sent you an encrypted secret; open it in ChatClient.]")
+
+	} else if response.Code == protocol.ResEdited {
+		return c.fromUser(response.Sender, "NOTICE", "#"+c.room, fmt.Sprintf("[edited #%d]> %s", response.ID, response.Message))
+
+	} else if response.Code == protocol.ResDeleted {
+		return c.fromUser(response.Sender, "NOTICE", "#"+c.room, fmt.Sprintf("[deleted #%d]", response.ID))
+
+	} else if response.Code == protocol.ResReaction {
+		return c.fromUser(response.Sender, "NOTICE", "#"+c.room, fmt.Sprintf("[reacted %s to #%d]", response.Message, response.ID))
+
+	} else if response.Code == protocol.ResOffer && response.File != nil {
+		return c.fromUser(response.Sender, "NOTICE", c.nickname,
+			fmt.Sprintf("[offers %s (%s); files need ChatClient.]", response.File.Name, filetransfer.FormatSize(response.File.Size)))
+
+	} else if response.Code == protocol.ResGroup {
+		return c.notice(fmt.Sprintf("[%s%s: %s]", protocol.GroupPrefix, response.Target, strings.Join(response.Members, ", ")))
+
+	} else if response.Code == protocol.ResReply || response.Code == protocol.ResMessage {
+		return c.notice(response.Message)
+	}
+
+	// Receipts, typing and keys have no IRC counterpart.
+	return nil
+}
+
+/** Return the registration replies for the server's answer to our connect request. **/
+func (c *Conn) welcome(response protocol.Response) []string {
+	if response.Code == protocol.ResError {
+		var lines []string
+		if response.Reason == protocol.ReasonNicknameUsed {
+			lines = append(lines, c.numericLine("433", c.nickname, response.Message))
+		} else if response.Reason == protocol.ReasonNickname {
+			lines = append(lines, c.numericLine("432", c.nickname, response.Message))
+		} else if response.Reason == protocol.ReasonPassword {
+			lines = append(lines, c.numericLine("464", response.Message))
+		} else if response.Reason == protocol.ReasonBanned {
+			lines = append(lines, c.numericLine("465", response.Message))
+		}
+		return append(lines, "ERROR :"+response.Message)
+	} else if response.Code != protocol.ResReply {
+		return []string{"ERROR :" + response.Message}
+	}
+
+	c.welcomed = true
+	lines := []string{
+		c.numericLine("001", "Welcome to the CAU net-class chat, "+c.nickname),
+		c.numericLine("002", "Your host is "+ServerName+", an IRC gateway to ChatServer"),
+		c.numericLine("003", "Channels are chat rooms; you are in one at a time"),
+		c.numericLine("004", ServerName, "chat", "o", "o"),
+		c.numericLine("005", "CHANTYPES=#", "NICKLEN=32", "MAXCHANNELS=1", "are supported by this server"),
+		c.numericLine("375", "- "+ServerName+" Message of the day -"),
+	}
+	for _, line := range strings.Split(response.Message, "\n") {
+		lines = append(lines, c.numericLine("372", "- "+line))
+	}
+	lines = append(lines, c.numericLine("376", "End of /MOTD command."))
+
+	if response.Event == protocol.EventJoin {
+		c.room = response.Target
+		lines = append(lines, c.prefix(c.nickname)+" JOIN #"+c.room, c.numericLine("331", "#"+c.room, "No topic is set"))
+	}
+	return lines
+}
+
+/** Answer NAMES, WHO or LIST from the reply to a ReqList. **/
+func (c *Conn) listReply(query listQuery, response protocol.Response) []string {
+	var lines []string
+
+	if query.command == "NAMES" {
+		channel := query.mask
+		if channel == "" {
+			channel = "#" + c.room
+		}
+		if members, ok := response.Rooms[channelRoom(channel)]; ok {
+			lines = append(lines, c.numericLine("353", "=", channel, strings.Join(members, " ")))
+		}
+		return append(lines, c.numericLine("366", channel, "End of /NAMES list."))
+
+	} else if query.command == "WHO" {
+		mask := query.mask
+		if mask == "" {
+			mask = "*"
+		}
+		for _, room := range sortedRooms(response.Rooms) {
+			for _, member := range response.Rooms[room] {
+				if mask == "*" || (isChannel(mask) && channelRoom(mask) == room) || strings.EqualFold(mask, member) {
+					lines = append(lines, c.numericLine("352", "#"+room, member, ServerName, ServerName, member, "H", "0 "+member))
+				}
+			}
+		}
+		return append(lines, c.numericLine("315", mask, "End of /WHO list."))
+	}
+
+	lines = append(lines, c.numericLine("321", "Channel", "Users  Name"))
+	for _, room := range sortedRooms(response.Rooms) {
+		lines = append(lines, c.numericLine("322", "#"+room, fmt.Sprint(len(response.Rooms[room])), ""))
+	}
+	return append(lines, c.numericLine("323", "End of /LIST"))
+}
+
+/** Return a message from nickname, one line per line of text. **/
+func (c *Conn) fromUser(nickname string, command string, target string, text string) []string {
+	var lines []string
+	for _, line := range splitLines(text) {
+		lines = append(lines, c.prefix(nickname)+" "+command+" "+word(target)+" :"+line)
+	}
+	return lines
+}
+
+/** Return a server notice, one line per non-empty line of text. **/
+func (c *Conn) notice(text string) []string {
+	var lines []string
+	for _, line := range splitLines(text) {
+		if line != "" {
+			lines = append(lines, ":"+ServerName+" NOTICE "+c.nickname+" :"+line)
+		}
+	}
+	return lines
+}
+
+/** Return the prefix that marks a line as coming from nickname. **/
+func (c *Conn) prefix(nickname string) string {
+	nickname = word(nickname)
+	return ":" + nickname + "!" + nickname + "@" + ServerName
+}
+
+/** Split text relayed from other users into lines, with CR and NUL removed from each. **/
+func splitLines(text string) []string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.NewReplacer("\r", "", "\x00", "").Replace(line)
+	}
+	return lines
+}
+
+/** Return s fit to be a single parameter: no spaces, line breaks or NUL. **/
+func word(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\r' || r == '\n' || r == 0 {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+/** Return a numeric reply line; the last parameter is the trailing one. **/
+func (c *Conn) numericLine(code string, params ...string) string {
+	target := c.nickname
+	if target == "" {
+		target = "*"
+	}
+
+	line := ":" + ServerName + " " + code + " " + target
+	for i, param := range params {
+		if i == len(params)-1 {
+			line += " :" + param
+		} else {
+			line += " " + param
+		}
+	}
+	return line
+}
+
+func sortedRooms(rooms map[string][]string) []string {
+	names := make([]string, 0, len(rooms))
+	for name := range rooms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
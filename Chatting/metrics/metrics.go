@@ -0,0 +1,201 @@
+/** metrics.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/** Something the registry can write in the Prometheus text format. **/
+type metric interface {
+	write(w io.Writer, name string)
+}
+
+type entry struct {
+	name   string
+	help   string
+	kind   string // counter, gauge or histogram
+	metric metric
+}
+
+/* Registered metrics, written in the order they were made */
+var (
+	registryMu sync.Mutex
+	registry   []entry
+)
+
+func register(name string, help string, kind string, m metric) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, entry{name: name, help: help, kind: kind, metric: m})
+}
+
+/** Write every metric in the Prometheus text format. **/
+func WriteTo(w io.Writer) {
+	registryMu.Lock()
+	entries := append([]entry(nil), registry...)
+	registryMu.Unlock()
+
+	for _, e := range entries {
+		fmt.Fprintf(w, "# HELP %s %s\n", e.name, e.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", e.name, e.kind)
+		e.metric.write(w, e.name)
+	}
+}
+
+/** Return a handler serving every metric, for "/metrics". **/
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+/** Float that can be added to from many goroutines. **/
+type value struct {
+	bits atomic.Uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (v *value) Load() float64 {
+	return math.Float64frombits(v.bits.Load())
+}
+
+/** Counter that only goes up. **/
+type Counter struct {
+	v value
+}
+
+func NewCounter(name string, help string) *Counter {
+	c := &Counter{}
+	register(name, help, "counter", c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+/** Add n, which must not be negative. **/
+func (c *Counter) Add(n float64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(c.v.Load()))
+}
+
+/** Counters told apart by the value of one label. **/
+type CounterVec struct {
+	label string
+
+	mu     sync.Mutex
+	values map[string]*Counter
+}
+
+func NewCounterVec(name string, help string, label string) *CounterVec {
+	c := &CounterVec{label: label, values: make(map[string]*Counter)}
+	register(name, help, "counter", c)
+	return c
+}
+
+/** Return the counter for a label value, starting it at zero the first time. **/
+func (c *CounterVec) With(labelValue string) *Counter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	counter, ok := c.values[labelValue]
+	if !ok {
+		counter = &Counter{}
+		c.values[labelValue] = counter
+	}
+	return counter
+}
+
+func (c *CounterVec) write(w io.Writer, name string) {
+	c.mu.Lock()
+	labelValues := make([]string, 0, len(c.values))
+	for labelValue := range c.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	c.mu.Unlock()
+	sort.Strings(labelValues)
+
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %s\n", name, c.label, escape(labelValue), formatFloat(c.With(labelValue).v.Load()))
+	}
+}
+
+/** Gauge read when the metrics are written. **/
+type GaugeFunc struct {
+	read func() float64
+}
+
+func NewGaugeFunc(name string, help string, read func() float64) *GaugeFunc {
+	g := &GaugeFunc{read: read}
+	register(name, help, "gauge", g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer, name string) {
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(g.read()))
+}
+
+/** Histogram counting observations into buckets by upper bound. **/
+type Histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // one per bound, plus +Inf
+	sum    value
+}
+
+/** bounds must be sorted. **/
+func NewHistogram(name string, help string, bounds []float64) *Histogram {
+	h := &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+	register(name, help, "histogram", h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.counts[i].Add(1)
+	h.sum.Add(v)
+}
+
+func (h *Histogram) write(w io.Writer, name string) {
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i].Load()
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+	}
+	cumulative += h.counts[len(h.bounds)].Load()
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, cumulative)
+	fmt.Fprintf(w, "%s_sum %s\n", name, formatFloat(h.sum.Load()))
+	fmt.Fprintf(w, "%s_count %d\n", name, cumulative)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+/** Escape a label value as the text format wants. **/
+func escape(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,374 @@
+/** moderation.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package moderation
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* Action, from least to most severe */
+type Action int
+
+const (
+	Allow Action = iota
+	Warn         // deliver, but warn the sender
+	Drop         // don't deliver
+	Mute         // don't deliver and mute the sender for a duration
+	Kick         // disconnect the sender
+	Ban          // disconnect the sender and refuse it from now on
+)
+
+var actionNames = map[string]Action{
+	"allow": Allow,
+	"warn":  Warn,
+	"drop":  Drop,
+	"mute":  Mute,
+	"kick":  Kick,
+	"ban":   Ban,
+}
+
+func (a Action) String() string {
+	for name, action := range actionNames {
+		if action == a {
+			return name
+		}
+	}
+	return fmt.Sprintf("action(%d)", int(a))
+}
+
+/* Ban target */
+const (
+	BanNickname = "nickname"
+	BanIP       = "ip"
+)
+
+/** A chat message as seen by the rules. **/
+type Message struct {
+	Nickname string
+	IP       string
+	Text     string
+	Time     time.Time
+}
+
+type Verdict struct {
+	Action   Action
+	Rule     string
+	Reason   string
+	Duration time.Duration // for Mute
+	BanBy    string        // for Ban: BanNickname or BanIP
+}
+
+/** A single moderation rule. Check returns Allow when the rule has nothing to say. **/
+type Rule interface {
+	Name() string
+	Check(msg Message) Verdict
+}
+
+/* Config file *
+ * {"rules": [{"type": "words", "words": ["i hate professor"], "action": "kick"}, ...]} */
+type Config struct {
+	Rules []RuleConfig `json:"rules"`
+}
+
+type RuleConfig struct {
+	Type     string   `json:"type"` // words, regex, rate, repeat or links
+	Action   string   `json:"action"`
+	Duration string   `json:"duration,omitempty"` // mute length, e.g. "5m"
+	BanBy    string   `json:"banBy,omitempty"`    // nickname (default) or ip
+	Words    []string `json:"words,omitempty"`    // words
+	Patterns []string `json:"patterns,omitempty"` // regex
+	Limit    int      `json:"limit,omitempty"`    // rate, repeat
+	Window   string   `json:"window,omitempty"`   // rate, repeat, e.g. "10s"
+}
+
+/** Rules used when no config file is given. **/
+var DefaultConfig = Config{
+	Rules: []RuleConfig{
+		{Type: "words", Words: []string{"i hate professor"}, Action: "kick"},
+	},
+}
+
+/** Chain of rules that every chat message runs through, reloadable while in use. **/
+type Pipeline struct {
+	mu    sync.RWMutex
+	path  string
+	rules []Rule
+}
+
+/** Load rules from path, or the default rules if path is empty. **/
+func Load(path string) (*Pipeline, error) {
+	p := &Pipeline{path: path}
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+/** Read the config file again and swap in its rules. The old rules stay on error. **/
+func (p *Pipeline) Reload() error {
+	config := DefaultConfig
+	if p.path != "" {
+		data, err := os.ReadFile(p.path)
+		if err != nil {
+			return err
+		}
+		config = Config{}
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("%s: %v", p.path, err)
+		}
+	}
+
+	rules, err := Build(config)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.rules = rules
+	p.mu.Unlock()
+	return nil
+}
+
+/** Run msg through every rule and return the most severe verdict. **/
+func (p *Pipeline) Check(msg Message) Verdict {
+	if msg.Time.IsZero() {
+		msg.Time = time.Now()
+	}
+
+	p.mu.RLock()
+	rules := p.rules
+	p.mu.RUnlock()
+
+	verdict := Verdict{Action: Allow}
+	for _, rule := range rules {
+		if v := rule.Check(msg); v.Action > verdict.Action {
+			verdict = v
+			verdict.Rule = rule.Name()
+		}
+	}
+	return verdict
+}
+
+/** Turn a config into rules. **/
+func Build(config Config) ([]Rule, error) {
+	var rules []Rule
+
+	for i, rc := range config.Rules {
+		base, err := rc.base(i)
+		if err != nil {
+			return nil, err
+		}
+
+		var rule Rule
+		switch rc.Type {
+		case "words":
+			rule = &WordRule{base: base, words: lower(rc.Words)}
+
+		case "regex":
+			var patterns []*regexp.Regexp
+			for _, pattern := range rc.Patterns {
+				re, err := regexp.Compile(pattern)
+				if err != nil {
+					return nil, fmt.Errorf("rule %d: %v", i, err)
+				}
+				patterns = append(patterns, re)
+			}
+			rule = &RegexRule{base: base, patterns: patterns}
+
+		case "rate":
+			window, err := parseDuration(rc.Window, 10*time.Second)
+			if err != nil || rc.Limit < 1 {
+				return nil, fmt.Errorf("rule %d: rate needs a positive limit and a window", i)
+			}
+			rule = &RateRule{base: base, limit: rc.Limit, window: window, sent: make(map[string][]time.Time)}
+
+		case "repeat":
+			window, err := parseDuration(rc.Window, time.Minute)
+			if err != nil || rc.Limit < 2 {
+				return nil, fmt.Errorf("rule %d: repeat needs a limit of at least 2", i)
+			}
+			rule = &RepeatRule{base: base, limit: rc.Limit, window: window, last: make(map[string]*repeatState)}
+
+		case "links":
+			rule = &LinkRule{base: base}
+
+		default:
+			return nil, fmt.Errorf("rule %d: unknown type %q", i, rc.Type)
+		}
+
+		rules = append(rules, rule)
+	}
+
+	return rules, nil
+}
+
+/** Fields shared by every rule. **/
+type base struct {
+	name     string
+	action   Action
+	duration time.Duration
+	banBy    string
+}
+
+func (rc RuleConfig) base(i int) (base, error) {
+	action, ok := actionNames[strings.ToLower(rc.Action)]
+	if !ok {
+		return base{}, fmt.Errorf("rule %d: unknown action %q", i, rc.Action)
+	}
+
+	duration, err := parseDuration(rc.Duration, 5*time.Minute)
+	if err != nil {
+		return base{}, fmt.Errorf("rule %d: %v", i, err)
+	}
+
+	banBy := BanNickname
+	if rc.BanBy != "" {
+		banBy = strings.ToLower(rc.BanBy)
+	}
+	if banBy != BanNickname && banBy != BanIP {
+		return base{}, fmt.Errorf("rule %d: banBy must be nickname or ip", i)
+	}
+
+	return base{name: fmt.Sprintf("%s#%d", rc.Type, i), action: action, duration: duration, banBy: banBy}, nil
+}
+
+func (b base) Name() string {
+	return b.name
+}
+
+func (b base) verdict(reason string) Verdict {
+	return Verdict{Action: b.action, Reason: reason, Duration: b.duration, BanBy: b.banBy}
+}
+
+/** Matches any of a list of words or phrases, ignoring case. **/
+type WordRule struct {
+	base
+	words []string
+}
+
+func (r *WordRule) Check(msg Message) Verdict {
+	text := strings.ToLower(msg.Text)
+	for _, word := range r.words {
+		if word != "" && strings.Contains(text, word) {
+			return r.verdict(fmt.Sprintf("used %q", word))
+		}
+	}
+	return Verdict{}
+}
+
+/** Matches any of a list of regular expressions. **/
+type RegexRule struct {
+	base
+	patterns []*regexp.Regexp
+}
+
+func (r *RegexRule) Check(msg Message) Verdict {
+	for _, re := range r.patterns {
+		if re.MatchString(msg.Text) {
+			return r.verdict(fmt.Sprintf("matched %s", re))
+		}
+	}
+	return Verdict{}
+}
+
+/** Allows at most limit messages per window from one nickname. **/
+type RateRule struct {
+	base
+	limit  int
+	window time.Duration
+
+	mu   sync.Mutex
+	sent map[string][]time.Time
+}
+
+func (r *RateRule) Check(msg Message) Verdict {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recent := r.sent[msg.Nickname]
+	for len(recent) > 0 && msg.Time.Sub(recent[0]) > r.window {
+		recent = recent[1:]
+	}
+	recent = append(recent, msg.Time)
+	r.sent[msg.Nickname] = recent
+
+	if len(recent) > r.limit {
+		return r.verdict(fmt.Sprintf("sent more than %d messages in %s", r.limit, r.window))
+	}
+	return Verdict{}
+}
+
+type repeatState struct {
+	text  string
+	count int
+	since time.Time
+}
+
+/** Catches the same message sent limit times in a row within window. **/
+type RepeatRule struct {
+	base
+	limit  int
+	window time.Duration
+
+	mu   sync.Mutex
+	last map[string]*repeatState
+}
+
+func (r *RepeatRule) Check(msg Message) Verdict {
+	text := strings.ToLower(strings.TrimSpace(msg.Text))
+	if text == "" {
+		return Verdict{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	state, ok := r.last[msg.Nickname]
+	if !ok || state.text != text || msg.Time.Sub(state.since) > r.window {
+		r.last[msg.Nickname] = &repeatState{text: text, count: 1, since: msg.Time}
+		return Verdict{}
+	}
+
+	state.count++
+	if state.count >= r.limit {
+		return r.verdict(fmt.Sprintf("repeated the same message %d times", state.count))
+	}
+	return Verdict{}
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://|ftp://|www\.)\S+`)
+
+/** Catches messages containing links. **/
+type LinkRule struct {
+	base
+}
+
+func (r *LinkRule) Check(msg Message) Verdict {
+	if link := linkPattern.FindString(msg.Text); link != "" {
+		return r.verdict(fmt.Sprintf("posted link %s", link))
+	}
+	return Verdict{}
+}
+
+func lower(words []string) []string {
+	lowered := make([]string, len(words))
+	for i, word := range words {
+		lowered[i] = strings.ToLower(word)
+	}
+	return lowered
+}
+
+func parseDuration(s string, fallback time.Duration) (time.Duration, error) {
+	if s == "" {
+		return fallback, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,90 @@
+/** sanctions.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package moderation
+
+import (
+	"sync"
+	"time"
+)
+
+/** Current mutes and bans, safe for concurrent use. **/
+type Sanctions struct {
+	mu          sync.Mutex
+	mutedUntil  map[string]time.Time
+	bannedNicks map[string]bool
+	bannedIPs   map[string]bool
+}
+
+func NewSanctions() *Sanctions {
+	return &Sanctions{
+		mutedUntil:  make(map[string]time.Time),
+		bannedNicks: make(map[string]bool),
+		bannedIPs:   make(map[string]bool),
+	}
+}
+
+/** Mute nickname for duration. **/
+func (s *Sanctions) Mute(nickname string, duration time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mutedUntil[nickname] = time.Now().Add(duration)
+}
+
+/** Lift a mute early. **/
+func (s *Sanctions) Unmute(nickname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.mutedUntil, nickname)
+}
+
+/** Return how much longer nickname stays muted, or 0. **/
+func (s *Sanctions) Muted(nickname string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	until, ok := s.mutedUntil[nickname]
+	if !ok {
+		return 0
+	}
+
+	left := time.Until(until)
+	if left <= 0 {
+		delete(s.mutedUntil, nickname)
+		return 0
+	}
+	return left
+}
+
+/** Refuse nickname from now on. **/
+func (s *Sanctions) BanNickname(nickname string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bannedNicks[nickname] = true
+}
+
+/** Refuse connections from ip from now on. **/
+func (s *Sanctions) BanIP(ip string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bannedIPs[ip] = true
+}
+
+/** Lift a ban on a nickname or an IP and return whether there was one. **/
+func (s *Sanctions) Unban(target string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	found := s.bannedNicks[target] || s.bannedIPs[target]
+	delete(s.bannedNicks, target)
+	delete(s.bannedIPs, target)
+	return found
+}
+
+/** Return whether the nickname or the IP is banned. Either may be empty. **/
+func (s *Sanctions) Banned(nickname string, ip string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bannedNicks[nickname] || s.bannedIPs[ip]
+}
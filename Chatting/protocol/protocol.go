@@ -0,0 +1,382 @@
+/** protocol.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+/* Request Code */
+type RequestCode byte
+
+const (
+	ReqConnect   RequestCode = 0 // make new connection
+	ReqBroadcast RequestCode = 1 // default (send to all)
+	ReqList      RequestCode = 2 // "\ls" command
+	ReqSecret    RequestCode = 3 // "\secret" command
+	ReqExcept    RequestCode = 4 // "\except" command
+	ReqPing      RequestCode = 5 // "\ping" command
+	ReqQuit      RequestCode = 6 // "\quit" command
+
+	// Room name goes in Header.Receiver.
+	ReqCreateRoom RequestCode = 7  // "\create" command, capacity in Body.Message
+	ReqJoinRoom   RequestCode = 8  // "\join" command
+	ReqLeaveRoom  RequestCode = 9  // "\leave" command
+	ReqListRooms  RequestCode = 10 // "\rooms" command
+
+	ReqHistory RequestCode = 11 // "\history" command, page number in Body.Message
+
+	// Operator only. Target nickname, IP or room goes in Header.Receiver.
+	ReqKick     RequestCode = 12 // "\kick" command, reason in Body.Message
+	ReqBan      RequestCode = 13 // "\ban" command
+	ReqUnban    RequestCode = 14 // "\unban" command
+	ReqMute     RequestCode = 15 // "\mute" command, duration in Body.Message
+	ReqAnnounce RequestCode = 16 // "\announce" command
+	ReqSetLimit RequestCode = 17 // "\setlimit" command, room in Header.Receiver, limit in Body.Message
+
+	ReqRegister RequestCode = 18 // "\register" command, password in Body.Password
+	ReqGetKey   RequestCode = 19 // public key of the nickname in Header.Receiver
+
+	ReqTyping RequestCode = 20 // typing notification for Header.Receiver, or the room if empty
+	ReqRead   RequestCode = 21 // read receipt, message ID in Body.Message, its sender in Header.Receiver
+
+	// Message ID goes in Header.Receiver.
+	ReqEdit   RequestCode = 22 // "\edit" command, new text in Body.Message
+	ReqDelete RequestCode = 23 // "\delete" command
+	ReqReact  RequestCode = 24 // "\react" command, emoji in Body.Message
+
+	// File transfers. Body.File describes the file.
+	ReqOffer    RequestCode = 25 // "\send" command, nickname or "all" in Header.Receiver
+	ReqDecline  RequestCode = 26 // "\decline" command
+	ReqUpload   RequestCode = 27 // first frame on a data connection, followed by the file's bytes
+	ReqDownload RequestCode = 28 // first frame on a data connection, answered by a ResReply and the file's bytes
+
+	ReqGroup RequestCode = 29 // "\group" command, action in Body.Message, group in Header.Receiver, nicknames in Header.Receivers
+)
+
+/* Response Code */
+type ResponseCode byte
+
+const (
+	ResRTT        ResponseCode = 0 // for RTT
+	ResReply      ResponseCode = 1 // response for my request
+	ResMessage    ResponseCode = 2 // message from other clients
+	ResError      ResponseCode = 3 // something bad
+	ResTerminated ResponseCode = 4 // server terminated
+	ResPublicKey  ResponseCode = 5 // public key of Sender, empty if it has none
+	ResEncrypted  ResponseCode = 6 // end-to-end encrypted secret from Sender
+	ResTyping     ResponseCode = 7 // Sender is typing
+	ResReceipt    ResponseCode = 8 // Sender got or read message ID, status in Message
+
+	// Sent to the audience of message ID; Sender is who did it.
+	ResEdited   ResponseCode = 9  // new text in Message
+	ResDeleted  ResponseCode = 10 // message removed
+	ResReaction ResponseCode = 11 // emoji in Message
+
+	// File transfers. File describes the file, DataPort where to carry it.
+	ResUpload ResponseCode = 12 // offer accepted, upload the file
+	ResOffer  ResponseCode = 13 // Sender offers a file; \accept downloads it, \decline refuses it
+
+	ResTargetError ResponseCode = 14 // Target could not be reached, Message says why; the other targets still are
+	ResGroup       ResponseCode = 15 // Members of group Target
+)
+
+/* A file offered to this receiver goes to everyone in the sender's room. */
+const AllReceivers = "all"
+
+/* Targets starting with GroupPrefix name one of the sender's groups instead of a nickname. */
+const GroupPrefix = "@"
+
+/* Nicknames are English letters only, MaxNicknameLength or less. */
+const MaxNicknameLength = 32
+
+/* Room names are English letters, digits, '-' and '_', MaxRoomNameLength or less. */
+const MaxRoomNameLength = 32
+
+/* ReqGroup action */
+const (
+	GroupCreate = "create" // new group of Header.Receivers
+	GroupAdd    = "add"    // add Header.Receivers
+	GroupRemove = "remove" // remove Header.Receivers
+	GroupDelete = "delete"
+	GroupShow   = "show" // answered by ResGroup
+	GroupList   = "list" // all of the sender's groups; Header.Receiver is empty
+)
+
+/* Room event, set with notices about someone entering or leaving a room */
+const (
+	EventJoin  = "join"  // Sender came into room Target; also set with the welcome and the reply to a join
+	EventLeave = "leave" // Sender moved from room Target to another room
+	EventQuit  = "quit"  // Sender left the chat from room Target
+)
+
+/* Failure reason, set with ResError and with replies to requests that did not go through */
+const (
+	ReasonBanned       = "banned"
+	ReasonFull         = "full" // server or room full
+	ReasonNicknameUsed = "nickname used"
+	ReasonNickname     = "invalid nickname"
+	ReasonPassword     = "password" // wrong or missing password, or too many failed logins
+	ReasonKicked       = "kicked"   // by Sender, or by the moderation rules if Sender is empty
+	ReasonNoSuchRoom   = "no such room"
+	ReasonRoomExists   = "room exists"
+	ReasonRoomName     = "invalid room name"
+	ReasonInRoom       = "already in room"
+)
+
+/* Receipt status */
+const (
+	ReceiptSent      = "sent" // to the sender of a broadcast or except, with its ID
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+/* Server heartbeat: a ResRTT with this message, answered by a ReqPing with the same message instead of an RTT. */
+const Heartbeat = "heartbeat"
+
+type Header struct {
+	Code     RequestCode `json:"code"`
+	Sender   string      `json:"sender"`
+	Receiver string      `json:"receiver"`
+
+	// Several nicknames or groups, for ReqSecret, ReqExcept, ReqTyping and ReqGroup. Used instead of Receiver when set.
+	Receivers []string `json:"receivers,omitempty"`
+}
+
+type Body struct {
+	Message string `json:"message"`
+
+	// Sent with ReqConnect only.
+	OperatorPassword string `json:"operatorPassword,omitempty"`
+
+	// Sent with ReqConnect for registered nicknames, and with ReqRegister.
+	Password string `json:"password,omitempty"`
+
+	// Sent with ReqConnect by clients that accept encrypted secrets.
+	PublicKey string `json:"publicKey,omitempty"`
+
+	// Set with ReqSecret when Message is sealed for the receiver.
+	Encrypted bool `json:"encrypted,omitempty"`
+
+	// Sent with ReqConnect to resume the session the server issued before a disconnect.
+	Session string `json:"session,omitempty"`
+
+	// Sent with file transfer requests.
+	File *FileInfo `json:"file,omitempty"`
+}
+
+type Request struct {
+	Header Header `json:"header"`
+	Body   Body   `json:"body"`
+}
+
+type Response struct {
+	Code    ResponseCode `json:"code"`
+	Message string       `json:"message"`
+
+	// Set with chat messages, ResPublicKey, ResTyping, ResReceipt, changes to messages, room events and kicks.
+	Sender string `json:"sender,omitempty"`
+
+	// Set with ResPublicKey only.
+	PublicKey string `json:"publicKey,omitempty"`
+
+	// Set with chat messages: an ID the server assigns and the time it was sent in Unix milliseconds.
+	// Changes to a message and receipts carry the ID of the message.
+	ID   uint64 `json:"id,omitempty"`
+	Time int64  `json:"time,omitempty"`
+
+	// Set with messages meant for one receiver only, like \secret.
+	Private bool `json:"private,omitempty"`
+
+	// Set with the welcome reply. Send it back in Body.Session to resume after a disconnect.
+	Session string `json:"session,omitempty"`
+
+	// Target is set with ResTargetError and ResGroup, and names the room of a room event.
+	// Members is set with ResGroup, and with the reply to ReqList where it names everyone online.
+	Target  string   `json:"target,omitempty"`
+	Members []string `json:"members,omitempty"`
+
+	// Set with the reply to ReqList: the members of each room.
+	Rooms map[string][]string `json:"rooms,omitempty"`
+
+	// Event and Reason say in a word what Message says in a sentence, for programs like gateways.
+	Event  string `json:"event,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// Set with ResUpload and ResOffer, and with the reply to a ReqDownload.
+	File     *FileInfo `json:"file,omitempty"`
+	DataPort string    `json:"dataPort,omitempty"`
+}
+
+/* File being transferred *
+ * ID and Token are assigned by the server when it takes the offer.
+ * Token must come with ReqUpload and ReqDownload on the data connection: the sender's
+ * upload token from ResUpload, or the receiver's own download token from ResOffer. */
+type FileInfo struct {
+	ID    string `json:"id,omitempty"`
+	Token string `json:"token,omitempty"`
+	Name  string `json:"name"`
+	Size  int64  `json:"size"`
+	Hash  string `json:"hash"` // SHA-256 in hex
+}
+
+/* Frame layout *
+ * [4-byte big-endian payload length][JSON payload] */
+const FrameHeaderSize = 4
+
+var MaxFrameSize = 64 * 1024
+
+var ErrFrameTooLarge = errors.New("frame too large")
+
+/** Return a request. **/
+func NewRequest(code RequestCode, sender string, receiver string, message string) Request {
+	return Request{
+		Header: Header{Code: code, Sender: sender, Receiver: receiver},
+		Body:   Body{Message: message},
+	}
+}
+
+/** Return a response. **/
+func NewResponse(code ResponseCode, message string) Response {
+	return Response{Code: code, Message: message}
+}
+
+/** Return whether nickname follows the nickname rules. **/
+func ValidNickname(nickname string) bool {
+	if len(nickname) == 0 || len(nickname) > MaxNicknameLength {
+		return false
+	}
+	for i := 0; i < len(nickname); i++ {
+		c := nickname[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+/** Return whether name follows the room name rules. **/
+func ValidRoomName(name string) bool {
+	if len(name) == 0 || len(name) > MaxRoomNameLength {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' && c != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+/** Return the nicknames or groups a request is for: Receivers, or Receiver alone if no list was sent. **/
+func (h Header) Targets() []string {
+	if len(h.Receivers) > 0 {
+		return h.Receivers
+	} else if h.Receiver != "" {
+		return []string{h.Receiver}
+	}
+	return nil
+}
+
+/** Encode a request into a frame payload. **/
+func EncodeRequest(request Request) ([]byte, error) {
+	return json.Marshal(request)
+}
+
+/** Decode a frame payload into a request. **/
+func DecodeRequest(payload []byte) (Request, error) {
+	var request Request
+	err := json.Unmarshal(payload, &request)
+	return request, err
+}
+
+/** Encode a response into a frame payload. **/
+func EncodeResponse(response Response) ([]byte, error) {
+	return json.Marshal(response)
+}
+
+/** Decode a frame payload into a response. **/
+func DecodeResponse(payload []byte) (Response, error) {
+	var response Response
+	err := json.Unmarshal(payload, &response)
+	return response, err
+}
+
+/** Encode and write a request as one frame. **/
+func WriteRequest(w io.Writer, request Request) error {
+	payload, err := EncodeRequest(request)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, payload)
+}
+
+/** Read one frame and decode it as a request. **/
+func ReadRequest(r io.Reader) (Request, error) {
+	payload, err := ReadFrame(r)
+	if err != nil {
+		return Request{}, err
+	}
+	return DecodeRequest(payload)
+}
+
+/** Encode and write a response as one frame. **/
+func WriteResponse(w io.Writer, response Response) error {
+	payload, err := EncodeResponse(response)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(w, payload)
+}
+
+/** Read one frame and decode it as a response. **/
+func ReadResponse(r io.Reader) (Response, error) {
+	payload, err := ReadFrame(r)
+	if err != nil {
+		return Response{}, err
+	}
+	return DecodeResponse(payload)
+}
+
+/** Write a single length-prefixed frame. **/
+func WriteFrame(w io.Writer, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+
+	// Header and payload go out in one Write so concurrent senders can't interleave.
+	frame := make([]byte, FrameHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[FrameHeaderSize:], payload)
+
+	_, err := w.Write(frame)
+	return err
+}
+
+/** Read a single length-prefixed frame, waiting until it has fully arrived.
+ * After ErrFrameTooLarge the payload is still unread and the stream out of sync, so the connection has to be closed. **/
+func ReadFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, FrameHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	size := int64(binary.BigEndian.Uint32(header))
+	if size > int64(MaxFrameSize) {
+		return nil, ErrFrameTooLarge // not drained: a peer could make us read up to 4 GiB
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err == io.EOF {
+		return nil, io.ErrUnexpectedEOF // the header came without its payload
+	} else if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -0,0 +1,294 @@
+/** protocol_test.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+/** Every request code should come back unchanged after encode, WriteFrame, ReadFrame and decode. **/
+func TestRequestRoundTrip(t *testing.T) {
+	file := &FileInfo{ID: "1", Token: "t", Name: "log.txt", Size: 42, Hash: strings.Repeat("ab", 32)}
+
+	tests := []struct {
+		name    string
+		request Request
+	}{
+		{"connect", Request{
+			Header: Header{Code: ReqConnect, Sender: "alice"},
+			Body:   Body{Password: "pw", OperatorPassword: "op", PublicKey: "key", Session: "s"},
+		}},
+		{"broadcast", NewRequest(ReqBroadcast, "alice", "", "hello")},
+		{"list", NewRequest(ReqList, "alice", "", "")},
+		{"secret", Request{
+			Header: Header{Code: ReqSecret, Sender: "alice", Receivers: []string{"bob", GroupPrefix + "team"}},
+			Body:   Body{Message: "sealed", Encrypted: true},
+		}},
+		{"except", Request{Header: Header{Code: ReqExcept, Sender: "alice", Receivers: []string{"bob"}}, Body: Body{Message: "hi"}}},
+		{"ping", NewRequest(ReqPing, "alice", "", Heartbeat)},
+		{"quit", NewRequest(ReqQuit, "alice", "", "")},
+		{"create room", NewRequest(ReqCreateRoom, "alice", "dev", "10")},
+		{"join room", NewRequest(ReqJoinRoom, "alice", "dev", "")},
+		{"leave room", NewRequest(ReqLeaveRoom, "alice", "dev", "")},
+		{"list rooms", NewRequest(ReqListRooms, "alice", "", "")},
+		{"history", NewRequest(ReqHistory, "alice", "", "2")},
+		{"kick", NewRequest(ReqKick, "boss", "bob", "spam")},
+		{"ban", NewRequest(ReqBan, "boss", "10.0.0.1", "")},
+		{"unban", NewRequest(ReqUnban, "boss", "10.0.0.1", "")},
+		{"mute", NewRequest(ReqMute, "boss", "bob", "5m")},
+		{"announce", NewRequest(ReqAnnounce, "boss", "", "maintenance")},
+		{"set limit", NewRequest(ReqSetLimit, "boss", "dev", "20")},
+		{"register", Request{Header: Header{Code: ReqRegister, Sender: "alice"}, Body: Body{Password: "pw"}}},
+		{"get key", NewRequest(ReqGetKey, "alice", "bob", "")},
+		{"typing", NewRequest(ReqTyping, "alice", "bob", "")},
+		{"read", NewRequest(ReqRead, "alice", "bob", "7")},
+		{"edit", NewRequest(ReqEdit, "alice", "7", "fixed")},
+		{"delete", NewRequest(ReqDelete, "alice", "7", "")},
+		{"react", NewRequest(ReqReact, "alice", "7", "👍")},
+		{"offer", Request{Header: Header{Code: ReqOffer, Sender: "alice", Receiver: AllReceivers}, Body: Body{File: file}}},
+		{"decline", Request{Header: Header{Code: ReqDecline, Sender: "bob"}, Body: Body{File: file}}},
+		{"upload", Request{Header: Header{Code: ReqUpload, Sender: "alice"}, Body: Body{File: file}}},
+		{"download", Request{Header: Header{Code: ReqDownload, Sender: "bob"}, Body: Body{File: file}}},
+		{"group", Request{Header: Header{Code: ReqGroup, Sender: "alice", Receiver: "team", Receivers: []string{"bob", "carol"}}, Body: Body{Message: GroupCreate}}},
+	}
+
+	seen := make(map[RequestCode]bool)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			if err := WriteRequest(&stream, test.request); err != nil {
+				t.Fatalf("WriteRequest: %v", err)
+			}
+			got, err := ReadRequest(&stream)
+			if err != nil {
+				t.Fatalf("ReadRequest: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.request) {
+				t.Errorf("got %+v, want %+v", got, test.request)
+			}
+			if stream.Len() != 0 {
+				t.Errorf("%d bytes left after the frame", stream.Len())
+			}
+		})
+		seen[test.request.Header.Code] = true
+	}
+
+	for code := ReqConnect; code <= ReqGroup; code++ {
+		if !seen[code] {
+			t.Errorf("request code %d has no round-trip test", code)
+		}
+	}
+}
+
+/** Every response code should come back unchanged after encode, WriteFrame, ReadFrame and decode. **/
+func TestResponseRoundTrip(t *testing.T) {
+	file := &FileInfo{ID: "1", Token: "t", Name: "shot.png", Size: 1 << 20, Hash: strings.Repeat("cd", 32)}
+
+	tests := []struct {
+		name     string
+		response Response
+	}{
+		{"rtt", NewResponse(ResRTT, Heartbeat)},
+		{"reply", Response{Code: ResReply, Message: "welcome", Session: "s", Event: EventJoin, Target: "lobby"}},
+		{"message", Response{Code: ResMessage, Message: "alice> hi", Sender: "alice", ID: 7, Time: 1700000000000, Private: true}},
+		{"list", Response{Code: ResMessage, Message: "2 users", Members: []string{"alice", "bob"}, Rooms: map[string][]string{"lobby": {"alice", "bob"}}}},
+		{"error", Response{Code: ResError, Message: "kicked", Sender: "boss", Reason: ReasonKicked}},
+		{"terminated", NewResponse(ResTerminated, "server shutting down")},
+		{"public key", Response{Code: ResPublicKey, Sender: "bob", PublicKey: "key"}},
+		{"encrypted", Response{Code: ResEncrypted, Message: "sealed", Sender: "alice", ID: 8}},
+		{"typing", Response{Code: ResTyping, Sender: "alice"}},
+		{"receipt", Response{Code: ResReceipt, Message: ReceiptRead, Sender: "bob", ID: 7}},
+		{"edited", Response{Code: ResEdited, Message: "fixed", Sender: "alice", ID: 7}},
+		{"deleted", Response{Code: ResDeleted, Sender: "alice", ID: 7}},
+		{"reaction", Response{Code: ResReaction, Message: "👍", Sender: "bob", ID: 7}},
+		{"upload", Response{Code: ResUpload, File: file, DataPort: "30771"}},
+		{"offer", Response{Code: ResOffer, Sender: "alice", File: file, DataPort: "30771"}},
+		{"target error", Response{Code: ResTargetError, Message: "no such user", Target: "carol"}},
+		{"group", Response{Code: ResGroup, Target: "team", Members: []string{"alice", "bob"}}},
+	}
+
+	seen := make(map[ResponseCode]bool)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			if err := WriteResponse(&stream, test.response); err != nil {
+				t.Fatalf("WriteResponse: %v", err)
+			}
+			got, err := ReadResponse(&stream)
+			if err != nil {
+				t.Fatalf("ReadResponse: %v", err)
+			}
+			if !reflect.DeepEqual(got, test.response) {
+				t.Errorf("got %+v, want %+v", got, test.response)
+			}
+		})
+		seen[test.response.Code] = true
+	}
+
+	for code := ResRTT; code <= ResGroup; code++ {
+		if !seen[code] {
+			t.Errorf("response code %d has no round-trip test", code)
+		}
+	}
+}
+
+/** Frames that arrive a byte at a time and several frames in one stream should both read back whole. **/
+func TestReadFrameStream(t *testing.T) {
+	payloads := [][]byte{[]byte("{}"), bytes.Repeat([]byte("x"), MaxFrameSize), nil}
+
+	var stream bytes.Buffer
+	for _, payload := range payloads {
+		if err := WriteFrame(&stream, payload); err != nil {
+			t.Fatalf("WriteFrame: %v", err)
+		}
+	}
+
+	r := &oneByteReader{r: &stream}
+	for i, want := range payloads {
+		got, err := ReadFrame(r)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("frame %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if _, err := ReadFrame(r); err != io.EOF {
+		t.Errorf("after the last frame: got %v, want io.EOF", err)
+	}
+}
+
+func TestWriteFrameTooLarge(t *testing.T) {
+	var stream bytes.Buffer
+	err := WriteFrame(&stream, make([]byte, MaxFrameSize+1))
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("got %v, want ErrFrameTooLarge", err)
+	}
+	if stream.Len() != 0 {
+		t.Errorf("%d bytes written for a frame that was refused", stream.Len())
+	}
+}
+
+func TestReadFrameTooLarge(t *testing.T) {
+	frame := make([]byte, FrameHeaderSize+MaxFrameSize+1)
+	binary.BigEndian.PutUint32(frame, uint32(MaxFrameSize+1))
+
+	r := bytes.NewReader(frame)
+	_, err := ReadFrame(r)
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("got %v, want ErrFrameTooLarge", err)
+	}
+	if r.Len() != MaxFrameSize+1 {
+		t.Errorf("%d payload bytes read; the oversized payload should be left alone", MaxFrameSize+1-r.Len())
+	}
+
+	// A huge length mustn't make ReadFrame wait for, or read, the payload.
+	binary.BigEndian.PutUint32(frame, 1<<32-1)
+	if _, err := ReadFrame(bytes.NewReader(frame[:FrameHeaderSize])); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("4 GiB length: got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func TestReadFrameTruncated(t *testing.T) {
+	var frame bytes.Buffer
+	if err := WriteFrame(&frame, []byte(`{"code":1,"message":"hello"}`)); err != nil {
+		t.Fatalf("WriteFrame: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, io.EOF},
+		{"short header", frame.Bytes()[:FrameHeaderSize-1], io.ErrUnexpectedEOF},
+		{"header only", frame.Bytes()[:FrameHeaderSize], io.ErrUnexpectedEOF},
+		{"short payload", frame.Bytes()[:frame.Len()-1], io.ErrUnexpectedEOF},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := ReadFrame(bytes.NewReader(test.data))
+			if err != test.want {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	if _, err := DecodeRequest([]byte("{not json")); err == nil {
+		t.Error("DecodeRequest accepted malformed JSON")
+	}
+	if _, err := DecodeResponse([]byte(`{"code":"two"}`)); err == nil {
+		t.Error("DecodeResponse accepted a string code")
+	}
+}
+
+/* Reader handing out one byte per Read, like a slow TCP stream */
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o *oneByteReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return o.r.Read(p[:1])
+}
+
+func TestValidNickname(t *testing.T) {
+	tests := []struct {
+		nickname string
+		want     bool
+	}{
+		{"alice", true},
+		{"Bob", true},
+		{strings.Repeat("a", MaxNicknameLength), true},
+		{strings.Repeat("a", MaxNicknameLength+1), false},
+		{"", false},
+		{"bob2", false},
+		{"bob smith", false},
+		{"alice,bob", false},
+		{"alice\r\nQUIT", false},
+		{"@team", false},
+		{"jürgen", false},
+	}
+
+	for _, test := range tests {
+		if got := ValidNickname(test.nickname); got != test.want {
+			t.Errorf("ValidNickname(%q) = %v, want %v", test.nickname, got, test.want)
+		}
+	}
+}
+
+func TestValidRoomName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{"dev", true},
+		{"team-2_B", true},
+		{strings.Repeat("r", MaxRoomNameLength), true},
+		{strings.Repeat("r", MaxRoomNameLength+1), false},
+		{"", false},
+		{"my room", false},
+		{"#dev", false},
+		{"dev\r\nQUIT", false},
+		{"café", false},
+	}
+
+	for _, test := range tests {
+		if got := ValidRoomName(test.name); got != test.want {
+			t.Errorf("ValidRoomName(%q) = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
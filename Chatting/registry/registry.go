@@ -0,0 +1,114 @@
+/** registry.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package registry
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+var ErrNicknameUsed = errors.New("nickname already used")
+var ErrFull = errors.New("server full")
+var ErrClosed = errors.New("registry closed")
+
+type entry[C any] struct {
+	id       int
+	nickname string
+	client   C
+}
+
+/** Registry of connected clients by ID and nickname, safe for concurrent use. **/
+type Registry[C any] struct {
+	mu         sync.RWMutex
+	byID       map[int]*entry[C]
+	byNickname map[string]*entry[C]
+	closed     bool // set on shutdown; nobody else gets in
+}
+
+func New[C any]() *Registry[C] {
+	return &Registry[C]{byID: make(map[int]*entry[C]), byNickname: make(map[string]*entry[C])}
+}
+
+/** Add client unless its nickname is taken or limit is reached, and return the new count. A limit of 0 means no limit. **/
+func (r *Registry[C]) Add(id int, nickname string, client C, limit int) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return len(r.byID), ErrClosed
+	}
+	if _, ok := r.byNickname[nickname]; ok {
+		return len(r.byID), ErrNicknameUsed
+	}
+	if limit > 0 && len(r.byID) >= limit {
+		return len(r.byID), ErrFull
+	}
+
+	e := &entry[C]{id: id, nickname: nickname, client: client}
+	r.byID[id] = e
+	r.byNickname[nickname] = e
+	return len(r.byID), nil
+}
+
+/** Remove client by ID and return whether it was present and the new count. **/
+func (r *Registry[C]) Remove(id int) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	e, ok := r.byID[id]
+	if !ok {
+		return len(r.byID), false
+	}
+
+	delete(r.byID, id)
+	delete(r.byNickname, e.nickname)
+	return len(r.byID), true
+}
+
+/** Return the client with nickname, or the zero C. **/
+func (r *Registry[C]) ByNickname(nickname string) C {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var client C
+	if e, ok := r.byNickname[nickname]; ok {
+		client = e.client
+	}
+	return client
+}
+
+/** Return the number of connected clients. **/
+func (r *Registry[C]) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.byID)
+}
+
+/** Return a copy of connected clients ordered by ID, safe to range over while others join or leave. **/
+func (r *Registry[C]) Snapshot() []C {
+	r.mu.RLock()
+	entries := make([]*entry[C], 0, len(r.byID))
+	for _, e := range r.byID {
+		entries = append(entries, e)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+
+	snapshot := make([]C, len(entries))
+	for i, e := range entries {
+		snapshot[i] = e.client
+	}
+	return snapshot
+}
+
+/** Refuse new clients from now on and return the connected ones. **/
+func (r *Registry[C]) Close() []C {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	return r.Snapshot()
+}
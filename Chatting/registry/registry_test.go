@@ -0,0 +1,166 @@
+/** registry_test.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package registry
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+type testClient struct {
+	id       int
+	received atomic.Int64
+}
+
+func TestAddRemove(t *testing.T) {
+	r := New[*testClient]()
+	alice, bob := &testClient{id: 1}, &testClient{id: 2}
+
+	if count, err := r.Add(1, "alice", alice, 2); err != nil || count != 1 {
+		t.Fatalf("Add alice: got %d, %v", count, err)
+	}
+	if _, err := r.Add(3, "alice", &testClient{id: 3}, 2); err != ErrNicknameUsed {
+		t.Errorf("second alice: got %v, want ErrNicknameUsed", err)
+	}
+	if count, err := r.Add(2, "bob", bob, 2); err != nil || count != 2 {
+		t.Fatalf("Add bob: got %d, %v", count, err)
+	}
+	if _, err := r.Add(4, "carol", &testClient{id: 4}, 2); err != ErrFull {
+		t.Errorf("past the limit: got %v, want ErrFull", err)
+	}
+
+	if r.ByNickname("alice") != alice || r.ByNickname("bob") != bob {
+		t.Error("lookup returned the wrong client")
+	}
+	if r.ByNickname("carol") != nil {
+		t.Error("lookup found a client that was never added")
+	}
+	if snapshot := r.Snapshot(); len(snapshot) != 2 || snapshot[0] != alice || snapshot[1] != bob {
+		t.Errorf("snapshot not in ID order: %v", snapshot)
+	}
+
+	if count, ok := r.Remove(1); !ok || count != 1 {
+		t.Errorf("Remove alice: got %d, %v", count, ok)
+	}
+	if _, ok := r.Remove(1); ok {
+		t.Error("alice removed twice")
+	}
+	if r.ByNickname("alice") != nil {
+		t.Error("alice still found by nickname after leaving")
+	}
+}
+
+func TestClose(t *testing.T) {
+	r := New[*testClient]()
+	r.Add(1, "alice", &testClient{id: 1}, 0)
+
+	if remaining := r.Close(); len(remaining) != 1 {
+		t.Errorf("Close returned %d clients, want 1", len(remaining))
+	}
+	if _, err := r.Add(2, "bob", &testClient{id: 2}, 0); err != ErrClosed {
+		t.Errorf("Add after Close: got %v, want ErrClosed", err)
+	}
+}
+
+/** Hundreds of clients join, broadcast and leave at once. Run with -race. **/
+func TestConcurrentStress(t *testing.T) {
+	const joiners = 300
+	const rounds = 10
+	const broadcasters = 4
+
+	r := New[*testClient]()
+	var delivered atomic.Int64
+
+	broadcast := func() {
+		for _, client := range r.Snapshot() {
+			client.received.Add(1)
+			delivered.Add(1)
+		}
+	}
+
+	stop := make(chan struct{})
+	var background sync.WaitGroup
+	for i := 0; i < broadcasters; i++ {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					broadcast()
+					r.Len()
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < joiners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for round := 0; round < rounds; round++ {
+				id := i*rounds + round
+				nickname := fmt.Sprintf("user%d", i)
+				client := &testClient{id: id}
+
+				if _, err := r.Add(id, nickname, client, 0); err != nil {
+					t.Errorf("%s: Add: %v", nickname, err)
+					return
+				}
+				if got := r.ByNickname(nickname); got != client {
+					t.Errorf("%s: ByNickname returned another client", nickname)
+				}
+
+				broadcast()
+
+				if _, ok := r.Remove(id); !ok {
+					t.Errorf("%s: Remove: not present", nickname)
+				}
+				if r.ByNickname(nickname) != nil {
+					t.Errorf("%s: still found after Remove", nickname)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	background.Wait()
+
+	if r.Len() != 0 {
+		t.Errorf("%d clients left after everyone left", r.Len())
+	}
+	if delivered.Load() < joiners*rounds {
+		t.Errorf("only %d deliveries for %d broadcasts by joined clients", delivered.Load(), joiners*rounds)
+	}
+}
+
+/** The same nickname raced by many clients is only ever held by one. **/
+func TestConcurrentSameNickname(t *testing.T) {
+	r := New[*testClient]()
+
+	var added atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 200; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := r.Add(i, "alice", &testClient{id: i}, 0); err == nil {
+				added.Add(1)
+			} else if err != ErrNicknameUsed {
+				t.Errorf("Add: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if added.Load() != 1 || r.Len() != 1 {
+		t.Errorf("%d clients got the nickname, %d registered; want 1", added.Load(), r.Len())
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+/** resize_other.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package tui
+
+/** Terminals without SIGWINCH are redrawn at their new size on Ctrl-L. **/
+func (s *Screen) watchResize() {}
@@ -0,0 +1,29 @@
+//go:build unix
+
+/** resize_unix.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package tui
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/** Redraw when the terminal window changes size. **/
+func (s *Screen) watchResize() {
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+
+	go func() {
+		for range winch {
+			s.mu.Lock()
+			s.resize()
+			s.tty.WriteString("\x1b[2J")
+			s.draw()
+			s.mu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,479 @@
+/** tui.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package tui
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+/* Message kind, which sets its colour */
+type Kind int
+
+const (
+	Broadcast Kind = iota // chat in the room
+	Secret                // meant for us alone
+	System                // notices, replies and everything printed to stdout
+	Own                   // lines we typed
+)
+
+var colours = map[Kind]string{
+	Broadcast: "",
+	Secret:    "\x1b[35m",
+	System:    "\x1b[36m",
+	Own:       "\x1b[1m",
+}
+
+const reset = "\x1b[0m"
+
+/* Layout *
+ * The message pane fills the screen above a status bar and the input line.
+ * A sidebar of users sits to its right when the terminal is wide enough. */
+const sidebarWidth = 20
+const minWidthForSidebar = 60
+const maxLines = 2000
+const prompt = "> "
+
+var ErrNotTerminal = errors.New("stdin is not a terminal")
+
+type line struct {
+	kind Kind
+	text string
+}
+
+/** A full-screen chat window on the terminal, safe for concurrent use. **/
+type Screen struct {
+	mu   sync.Mutex
+	once sync.Once
+	tty  *os.File // the real stdout
+	keys *bufio.Reader
+
+	rows, cols int
+	lines      []line
+	scroll     int // rows scrolled back from the bottom
+	users      []string
+	title      string
+	status     string
+
+	input   []rune
+	cursor  int
+	history []string
+	recall  int    // index into history while browsing it
+	draft   []rune // what was typed before browsing history
+
+	pipe     *os.File
+	captured chan struct{}
+}
+
+/** Take over the terminal and capture stdout into the message pane. Close gives it back. **/
+func Open(title string) (*Screen, error) {
+	info, err := os.Stdin.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil, ErrNotTerminal
+	}
+	if err := stty("-icanon", "-echo", "min", "1"); err != nil {
+		return nil, err
+	}
+
+	s := &Screen{tty: os.Stdout, keys: bufio.NewReader(os.Stdin), title: title, captured: make(chan struct{})}
+	s.resize()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		stty("icanon", "echo")
+		return nil, err
+	}
+	s.pipe = w
+	os.Stdout = w
+	go s.capture(r)
+
+	s.tty.WriteString("\x1b[?1049h") // alternate screen, so the shell's screen comes back on exit
+	s.watchResize()
+
+	s.mu.Lock()
+	s.draw()
+	s.mu.Unlock()
+	return s, nil
+}
+
+/** Give the terminal back and print the last message, so the reason for leaving stays visible. **/
+func (s *Screen) Close() {
+	s.once.Do(func() {
+		os.Stdout = s.tty
+		s.pipe.Close()
+		<-s.captured
+
+		s.tty.WriteString("\x1b[?1049l")
+		stty("icanon", "echo")
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(s.lines) > 0 {
+			fmt.Fprintln(s.tty, s.lines[len(s.lines)-1].text)
+		}
+	})
+}
+
+/** Add a message to the pane. **/
+func (s *Screen) Print(kind Kind, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, part := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		s.lines = append(s.lines, line{kind: kind, text: part})
+		if s.scroll > 0 { // keep what the user scrolled back to in place
+			s.scroll += len(wrap(part, s.paneWidth()))
+		}
+	}
+	if len(s.lines) > maxLines {
+		s.lines = s.lines[len(s.lines)-maxLines:]
+	}
+	s.clampScroll(len(s.wrapped()))
+	s.draw()
+}
+
+/** Show users in the sidebar. **/
+func (s *Screen) SetUsers(users []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append([]string(nil), users...)
+	s.draw()
+}
+
+/** Show text in the status bar, or clear it with "". **/
+func (s *Screen) SetStatus(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = text
+	s.draw()
+}
+
+/** Read a line from the input line. While it is typed, typing is called with the line so far every interval until it reports sending a notice. **/
+func (s *Screen) ReadLine(typing func(line string) bool, interval time.Duration) (string, error) {
+	var noticed time.Time
+	for {
+		r, _, err := s.keys.ReadRune()
+		if err != nil {
+			return "", err
+		}
+
+		s.mu.Lock()
+		done := s.key(r)
+		if done {
+			text := string(s.input)
+			s.remember(text)
+			s.lines = append(s.lines, line{kind: Own, text: prompt + text})
+			s.input, s.cursor, s.scroll = nil, 0, 0
+			s.draw()
+			s.mu.Unlock()
+			return text, nil
+		}
+		text := string(s.input)
+		s.draw()
+		s.mu.Unlock()
+
+		if r >= 0x20 && time.Since(noticed) > interval && typing(text) {
+			noticed = time.Now()
+		}
+	}
+}
+
+/** Caller must hold s.mu. Apply key r to the input and return whether it ended the line. **/
+func (s *Screen) key(r rune) bool {
+	switch r {
+	case '\r', '\n':
+		return true
+	case 0x7f, '\b': // backspace
+		if s.cursor > 0 {
+			s.input = append(s.input[:s.cursor-1], s.input[s.cursor:]...)
+			s.cursor--
+		}
+	case 0x15: // Ctrl-U
+		s.input, s.cursor = nil, 0
+	case 0x01: // Ctrl-A
+		s.cursor = 0
+	case 0x05: // Ctrl-E
+		s.cursor = len(s.input)
+	case 0x0c: // Ctrl-L
+		s.resize()
+		s.tty.WriteString("\x1b[2J")
+	case 0x1b:
+		s.escape()
+	default:
+		if r >= 0x20 {
+			s.input = append(s.input[:s.cursor], append([]rune{r}, s.input[s.cursor:]...)...)
+			s.cursor++
+		}
+	}
+	return false
+}
+
+/** Caller must hold s.mu. Read the rest of an escape sequence and act on it. **/
+func (s *Screen) escape() {
+	intro, _, err := s.keys.ReadRune()
+	if err != nil || (intro != '[' && intro != 'O') {
+		return
+	}
+
+	var params []rune
+	var final rune
+	for {
+		c, _, err := s.keys.ReadRune()
+		if err != nil {
+			return
+		}
+		if c >= 0x40 && c <= 0x7e {
+			final = c
+			break
+		}
+		params = append(params, c)
+	}
+
+	switch final {
+	case 'A': // up
+		s.recallHistory(-1)
+	case 'B': // down
+		s.recallHistory(1)
+	case 'C': // right
+		if s.cursor < len(s.input) {
+			s.cursor++
+		}
+	case 'D': // left
+		if s.cursor > 0 {
+			s.cursor--
+		}
+	case 'H':
+		s.cursor = 0
+	case 'F':
+		s.cursor = len(s.input)
+	case '~':
+		switch string(params) {
+		case "1", "7": // home
+			s.cursor = 0
+		case "4", "8": // end
+			s.cursor = len(s.input)
+		case "3": // delete
+			if s.cursor < len(s.input) {
+				s.input = append(s.input[:s.cursor], s.input[s.cursor+1:]...)
+			}
+		case "5": // page up
+			s.scroll += s.paneRows() - 1
+		case "6": // page down
+			s.scroll -= s.paneRows() - 1
+		}
+		s.clampScroll(len(s.wrapped()))
+	}
+}
+
+/** Caller must hold s.mu. Add text to the input history. **/
+func (s *Screen) remember(text string) {
+	if text != "" && (len(s.history) == 0 || s.history[len(s.history)-1] != text) {
+		s.history = append(s.history, text)
+	}
+	s.recall = len(s.history)
+	s.draft = nil
+}
+
+/** Caller must hold s.mu. Move step lines through the input history. **/
+func (s *Screen) recallHistory(step int) {
+	next := s.recall + step
+	if next < 0 || next > len(s.history) {
+		return
+	}
+	if s.recall == len(s.history) {
+		s.draft = s.input
+	}
+	s.recall = next
+
+	if next == len(s.history) {
+		s.input = s.draft
+	} else {
+		s.input = []rune(s.history[next])
+	}
+	s.cursor = len(s.input)
+}
+
+/** Move whatever is printed to stdout into the pane. A line rewritten with "\r" shows in the status bar until it ends. **/
+func (s *Screen) capture(r *os.File) {
+	defer close(s.captured)
+
+	var current []byte
+	buffer := make([]byte, 4096)
+	for {
+		n, err := r.Read(buffer)
+		for _, b := range buffer[:n] {
+			if b == '\n' {
+				if len(current) > 0 {
+					s.Print(System, string(current))
+					s.SetStatus("")
+				}
+				current = current[:0]
+			} else if b == '\r' {
+				if len(current) > 0 {
+					s.SetStatus(string(current))
+				}
+				current = current[:0]
+			} else {
+				current = append(current, b)
+			}
+		}
+		if err != nil {
+			if len(current) > 0 {
+				s.Print(System, string(current))
+			}
+			r.Close()
+			return
+		}
+	}
+}
+
+/** Caller must hold s.mu. Ask the terminal for its size. **/
+func (s *Screen) resize() {
+	s.rows, s.cols = 24, 80
+
+	cmd := exec.Command("stty", "size")
+	cmd.Stdin = os.Stdin
+	out, err := cmd.Output()
+	if err != nil {
+		return
+	}
+	var rows, cols int
+	if _, err := fmt.Sscan(string(out), &rows, &cols); err == nil && rows > 3 && cols > 10 {
+		s.rows, s.cols = rows, cols
+	}
+}
+
+func (s *Screen) paneRows() int {
+	return s.rows - 2
+}
+
+func (s *Screen) paneWidth() int {
+	if s.cols >= minWidthForSidebar {
+		return s.cols - sidebarWidth - 1
+	}
+	return s.cols
+}
+
+/** Caller must hold s.mu. Return the pane's lines wrapped to its width. **/
+func (s *Screen) wrapped() []line {
+	var rows []line
+	for _, l := range s.lines {
+		for _, part := range wrap(l.text, s.paneWidth()) {
+			rows = append(rows, line{kind: l.kind, text: part})
+		}
+	}
+	return rows
+}
+
+/** Caller must hold s.mu. Keep scroll between the bottom and the oldest rows there are, which drops as old lines go and the terminal resizes. **/
+func (s *Screen) clampScroll(rows int) {
+	if most := rows - s.paneRows(); s.scroll > most {
+		s.scroll = most
+	}
+	if s.scroll < 0 {
+		s.scroll = 0
+	}
+}
+
+/** Caller must hold s.mu. Redraw the whole screen. **/
+func (s *Screen) draw() {
+	var b strings.Builder
+	b.WriteString("\x1b[?25l") // hide the cursor while drawing
+
+	rows := s.wrapped()
+	s.clampScroll(len(rows)) // the terminal may have shrunk since
+	end := len(rows) - s.scroll
+	start := end - s.paneRows()
+	if start < 0 {
+		start = 0
+	}
+	visible := rows[start:end]
+
+	sidebar := s.cols >= minWidthForSidebar
+	for i := 0; i < s.paneRows(); i++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", i+1)
+
+		// Pad the top so the newest message sits just above the status bar.
+		j := i - (s.paneRows() - len(visible))
+		if j >= 0 {
+			b.WriteString(colours[visible[j].kind] + pad(visible[j].text, s.paneWidth()) + reset)
+		} else {
+			b.WriteString(pad("", s.paneWidth()))
+		}
+
+		if sidebar {
+			b.WriteString("\x1b[2m│\x1b[0m")
+			if i == 0 {
+				b.WriteString("\x1b[1m" + pad(fmt.Sprintf(" Online (%d)", len(s.users)), sidebarWidth) + reset)
+			} else if i-1 < len(s.users) {
+				b.WriteString(pad(" "+s.users[i-1], sidebarWidth))
+			} else {
+				b.WriteString(pad("", sidebarWidth))
+			}
+		}
+	}
+
+	bar := " " + s.title
+	if s.status != "" {
+		bar += "  " + s.status
+	}
+	if s.scroll > 0 {
+		bar += fmt.Sprintf("  [scrolled back %d lines, PgDn to return]", s.scroll)
+	}
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[7m%s%s", s.rows-1, pad(bar, s.cols), reset)
+
+	// Scroll the input sideways so the cursor stays on screen.
+	room := s.cols - len(prompt) - 1
+	offset := s.cursor - room
+	if offset < 0 {
+		offset = 0
+	}
+	shown := s.input[offset:]
+	if len(shown) > room {
+		shown = shown[:room]
+	}
+	fmt.Fprintf(&b, "\x1b[%d;1H%s%s\x1b[K", s.rows, prompt, string(shown))
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", s.rows, len(prompt)+s.cursor-offset+1)
+
+	s.tty.WriteString(b.String())
+}
+
+/** Split text into pieces of at most width characters. **/
+func wrap(text string, width int) []string {
+	text = strings.ReplaceAll(text, "\t", "    ")
+	if width < 1 || utf8.RuneCountInString(text) <= width {
+		return []string{text}
+	}
+
+	var parts []string
+	runes := []rune(text)
+	for len(runes) > width {
+		parts = append(parts, string(runes[:width]))
+		runes = runes[width:]
+	}
+	return append(parts, string(runes))
+}
+
+/** Cut or fill text with spaces to exactly width characters. **/
+func pad(text string, width int) string {
+	n := utf8.RuneCountInString(text)
+	if n > width {
+		return string([]rune(text)[:width])
+	}
+	return text + strings.Repeat(" ", width-n)
+}
+
+func stty(args ...string) error {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	return cmd.Run()
+}
@@ -0,0 +1,94 @@
+/** webchat.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package webchat
+
+import (
+	_ "embed"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Browser client served at "/".
+//
+//go:embed index.html
+var page []byte
+
+/* Where the browser client connects */
+const SocketPath = "/ws"
+
+/** Listener serving the browser client over HTTP and handing out the WebSocket connections it opens. **/
+type Listener struct {
+	inner  net.Listener
+	server *http.Server
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+/** Serve HTTP on inner and return a listener whose Accept returns each browser that connects to SocketPath. **/
+func Listen(inner net.Listener) *Listener {
+	l := &Listener{
+		inner:  inner,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", l.servePage)
+	mux.HandleFunc(SocketPath, l.serveSocket)
+	l.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go l.server.Serve(inner)
+	return l
+}
+
+/** Wait for the next browser. **/
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+/** Stop serving HTTP. Browsers already accepted stay connected. **/
+func (l *Listener) Close() error {
+	err := net.ErrClosed
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *Listener) Addr() net.Addr {
+	return l.inner.Addr()
+}
+
+func (l *Listener) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+func (l *Listener) serveSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := Upgrade(w, r)
+	if err != nil {
+		return
+	}
+
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
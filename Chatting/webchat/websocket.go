@@ -0,0 +1,348 @@
+/** websocket.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package webchat
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/young-jin-son/Network-Practice/Chatting/protocol"
+)
+
+/* Opcode */
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+/* Close status */
+const (
+	closeNormal   = 1000
+	closeProtocol = 1002
+	closeTooBig   = 1009
+)
+
+// Sec-WebSocket-Accept is the SHA-1 of the client's key followed by this.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Largest message a browser may send. Bigger than protocol.MaxFrameSize so ReadFrame can still answer "too long".
+var MaxMessageSize = 1 << 20
+
+// Origins besides the server's own whose pages may open a WebSocket, like "https://chat.example.com".
+// "*" lets any page in. Requests without an Origin header don't come from a browser page and are let in.
+var AllowedOrigins []string
+
+var ErrBadHandshake = errors.New("not a websocket handshake")
+var ErrBadOrigin = errors.New("websocket origin not allowed")
+var ErrMessageTooLarge = errors.New("websocket message too large")
+var errProtocol = errors.New("websocket protocol error")
+
+/* WebSocket connection carrying chat frames *
+ * Each text or binary message from the browser reads as one length-prefixed frame,
+ * and each frame written goes out as one text message, so the server can treat
+ * a browser like any other connection. */
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	readBuf []byte // rest of the frame being read
+
+	writeMu  sync.Mutex
+	writeBuf []byte // start of a frame not fully written yet
+
+	closeOnce sync.Once
+}
+
+/** Complete the WebSocket handshake on an HTTP request and take over its connection. **/
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || key == "" ||
+		!headerHas(r.Header, "Connection", "upgrade") || !headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "websocket handshake expected", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !originAllowed(origin, r.Host) {
+		// Another site's page would be chatting with the visitor's IP and cookies.
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, ErrBadHandshake
+	}
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	h := sha1.New()
+	h.Write([]byte(key + acceptGUID))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	conn.SetDeadline(time.Time{})
+	_, err = conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: conn, reader: buffered.Reader}, nil
+}
+
+/** Report whether a page from origin may connect to host: the same host, or one of AllowedOrigins. **/
+func originAllowed(origin string, host string) bool {
+	for _, allowed := range AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return true
+		}
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, host)
+}
+
+/** Report whether a comma-separated header lists token, ignoring case. **/
+func headerHas(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, field := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(field), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/** Read the next message as a length-prefixed frame. **/
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.readBuf) == 0 {
+		message, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf = make([]byte, protocol.FrameHeaderSize+len(message))
+		binary.BigEndian.PutUint32(c.readBuf, uint32(len(message)))
+		copy(c.readBuf[protocol.FrameHeaderSize:], message)
+	}
+
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+/** Send every complete length-prefixed frame in p as a text message, keeping any partial one for the next Write. **/
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	c.writeBuf = append(c.writeBuf, p...)
+	for len(c.writeBuf) >= protocol.FrameHeaderSize {
+		size := int(binary.BigEndian.Uint32(c.writeBuf))
+		if len(c.writeBuf) < protocol.FrameHeaderSize+size {
+			break
+		}
+		payload := c.writeBuf[protocol.FrameHeaderSize : protocol.FrameHeaderSize+size]
+		if err := c.writeFrame(opText, payload); err != nil {
+			c.writeBuf = nil
+			return 0, err
+		}
+		c.writeBuf = c.writeBuf[protocol.FrameHeaderSize+size:]
+	}
+	return len(p), nil
+}
+
+/** Say goodbye to the browser and close the connection. **/
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.writeMu.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(opClose, closePayload(closeNormal))
+		c.writeMu.Unlock()
+	})
+	return c.conn.Close()
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+/** Read frames until a whole data message has arrived, answering pings and closes along the way. **/
+func (c *Conn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err == ErrMessageTooLarge {
+			c.fail(closeTooBig)
+			return nil, err
+		} else if err != nil {
+			return nil, err
+		}
+
+		if opcode == opPing {
+			c.writeMu.Lock()
+			err = c.writeFrame(opPong, payload)
+			c.writeMu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if opcode == opPong {
+			continue
+		} else if opcode == opClose {
+			c.fail(closeNormal)
+			return nil, io.EOF
+		} else if opcode == opText || opcode == opBinary {
+			if started {
+				c.fail(closeProtocol)
+				return nil, errProtocol
+			}
+			started = true
+		} else if opcode != opContinuation || !started {
+			c.fail(closeProtocol)
+			return nil, errProtocol
+		}
+
+		if len(message)+len(payload) > MaxMessageSize {
+			c.fail(closeTooBig)
+			return nil, ErrMessageTooLarge
+		}
+		message = append(message, payload...)
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+/** Read one frame and unmask its payload. **/
+func (c *Conn) readFrame() (bool, byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	opcode := head[0] & 0x0F
+	if head[1]&0x80 == 0 {
+		c.fail(closeProtocol)
+		return false, 0, nil, errProtocol
+	}
+
+	size := uint64(head[1] & 0x7F)
+	if size == 126 {
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	} else if size == 127 {
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	if opcode&0x8 != 0 && (!fin || size > 125) {
+		// Control frames may not be fragmented and must fit in a short frame.
+		c.fail(closeProtocol)
+		return false, 0, nil, errProtocol
+	}
+	if size > uint64(MaxMessageSize) {
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, opcode, payload, nil
+}
+
+/** Write one unmasked, unfragmented frame. Callers hold writeMu. **/
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, 10+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	size := len(payload)
+	if size < 126 {
+		frame = append(frame, byte(size))
+	} else if size <= 0xFFFF {
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	} else {
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+	frame = append(frame, payload...)
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+/** Send a close frame with status and stop writing. **/
+func (c *Conn) fail(status int) {
+	c.closeOnce.Do(func() {
+		c.writeMu.Lock()
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(opClose, closePayload(status))
+		c.writeMu.Unlock()
+	})
+}
+
+func closePayload(status int) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(status))
+}
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"net"
@@ -13,20 +14,29 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+
+	"github.com/young-jin-son/Network-Practice/config"
 )
 
+var server1 = "nsl2.cau.ac.kr:40768"
+var server2 = "nsl2.cau.ac.kr:50768"
+
 func main() {
-	server1 := "nsl2.cau.ac.kr:40768"
-	server2 := "nsl2.cau.ac.kr:50768"
+	flag.StringVar(&server1, "server1", server1, "address of the server keeping the odd part")
+	flag.StringVar(&server2, "server2", server2, "address of the server keeping the even part")
+	if err := config.Parse("splitfileclient"); err != nil {
+		fmt.Println("Error reading configuration:", err)
+		os.Exit(1)
+	}
 
 	// Check command and file name
-	if len(os.Args) < 3 {
+	if flag.NArg() < 2 {
 		fmt.Println("Please enter command and file name.")
 		os.Exit(0)
 	}
 
-	command := os.Args[1]
-	fileName := os.Args[2]
+	command := flag.Arg(0)
+	fileName := flag.Arg(1)
 
 	if command != "get" && command != "put" {
 		fmt.Println("Please enter a valid command.")
@@ -6,6 +6,7 @@ package main
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
 	"io"
 	"net"
@@ -13,17 +14,28 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+
+	"github.com/young-jin-son/Network-Practice/config"
 )
 
+var serverPort = ""
+
 func main() {
+	flag.StringVar(&serverPort, "port", serverPort, "port to listen on (or give it as the first argument)")
+	if err := config.Parse("splitfileserver"); err != nil {
+		fmt.Println("Error reading configuration:", err)
+		os.Exit(1)
+	}
+
 	// Check port number
-	if len(os.Args) < 2 {
+	if flag.NArg() > 0 {
+		serverPort = flag.Arg(0)
+	}
+	if serverPort == "" {
 		fmt.Println("Please enter port number.")
 		os.Exit(0)
 	}
 
-	serverPort := os.Args[1]
-
 	listner, err := net.Listen("tcp", ":"+serverPort)
 	if err != nil {
 		fmt.Println("Error listening:", err)
@@ -7,12 +7,15 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"github.com/young-jin-son/Network-Practice/config"
 )
 
 type MyPacket struct {
@@ -24,8 +27,16 @@ type MyPacket struct {
 	} `json:"body"`
 }
 
+var serverPort = "30768"
+var bufferSize = 1024
+
 func main() {
-	serverPort := "30768"
+	flag.StringVar(&serverPort, "port", serverPort, "server port")
+	flag.IntVar(&bufferSize, "buffer", bufferSize, "size of the receive buffer in bytes")
+	if err := config.Parse("multitcpserver"); err != nil {
+		fmt.Println("Error reading configuration:", err)
+		os.Exit(1)
+	}
 
 	listener, err := net.Listen("tcp", ":"+serverPort)
 	if err != nil {
@@ -89,7 +100,7 @@ func handleConn(conn net.Conn, clientID int, clientNum *int, requestCount *int,
 	clientAddr := conn.RemoteAddr().(*net.TCPAddr)
 
 	for {
-		buffer := make([]byte, 1024)
+		buffer := make([]byte, bufferSize)
 
 		n, err := conn.Read(buffer)
 		if err != nil {
@@ -7,6 +7,7 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -14,6 +15,8 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/young-jin-son/Network-Practice/config"
 )
 
 type MyPacket struct {
@@ -25,9 +28,20 @@ type MyPacket struct {
 	} `json:"body"`
 }
 
+var serverName = "localhost"
+var serverPort = "30768"
+var bufferSize = 1024
+var responseTimeout = time.Second
+
 func main() {
-	serverName := "localhost"
-	serverPort := "30768"
+	flag.StringVar(&serverName, "server", serverName, "server host name")
+	flag.StringVar(&serverPort, "port", serverPort, "server port")
+	flag.IntVar(&bufferSize, "buffer", bufferSize, "size of the receive buffer in bytes")
+	flag.DurationVar(&responseTimeout, "timeout", responseTimeout, "how long to wait for a response")
+	if err := config.Parse("tcpclient"); err != nil {
+		fmt.Println("Error reading configuration:", err)
+		os.Exit(1)
+	}
 
 	conn, err := net.Dial("tcp", serverName+":"+serverPort)
 	if err != nil {
@@ -129,8 +143,8 @@ func sendReq(conn net.Conn, packet []byte) error {
 
 /** Return response, rtt and error */
 func receiveRes(conn net.Conn, sendTime time.Time) (string, time.Duration, error) {
-	buffer := make([]byte, 1024)
-	conn.SetReadDeadline(time.Now().Add(time.Second)) // Timeout 1s
+	buffer := make([]byte, bufferSize)
+	conn.SetReadDeadline(time.Now().Add(responseTimeout))
 
 	n, err := conn.Read(buffer)
 	rtt := time.Since(sendTime)
@@ -6,6 +6,7 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
 	"net"
 	"os"
@@ -13,6 +14,8 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/young-jin-son/Network-Practice/config"
 )
 
 type MyPacket struct {
@@ -24,8 +27,16 @@ type MyPacket struct {
 	} `json:"body"`
 }
 
+var serverPort = "20768"
+var bufferSize = 1024
+
 func main() {
-	serverPort := "20768"
+	flag.StringVar(&serverPort, "port", serverPort, "server port")
+	flag.IntVar(&bufferSize, "buffer", bufferSize, "size of the receive buffer in bytes")
+	if err := config.Parse("udpserver"); err != nil {
+		fmt.Println("Error reading configuration:", err)
+		os.Exit(1)
+	}
 
 	pconn, err := net.ListenPacket("udp", ":"+serverPort)
 	if err != nil {
@@ -38,7 +49,7 @@ func main() {
 	requestCount := 0
 
 	fmt.Printf("Server is ready to receive on port %s\n", serverPort)
-	buffer := make([]byte, 1024)
+	buffer := make([]byte, bufferSize)
 
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
@@ -0,0 +1,213 @@
+/** config.go
+ * Student ID: 20200768
+ * Name: Youngjin Son **/
+
+package config
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/* Where a flag gets its value, first match wins *
+ * 1. the command line
+ * 2. <PROGRAM>_<FLAG>, then NETPRACTICE_<FLAG> in the environment
+ * 3. the [program] section of the config file
+ * 4. the top level of the config file, shared by every program
+ * 5. the flag's default
+ * The config file is named by -config or <PROGRAM>_CONFIG and may be TOML (.toml) or YAML (.yaml, .yml). */
+
+const sharedPrefix = "NETPRACTICE"
+
+/** Parse the command line like flag.Parse, then fill the flags it didn't set from the environment and the config file. **/
+func Parse(program string) error {
+	path := flag.String("config", os.Getenv(envName(program, "config")), "TOML or YAML file with settings (flags and environment override it)")
+	flag.Parse()
+
+	setOnCommandLine := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	sections := map[string]map[string]string{}
+	if *path != "" {
+		var err error
+		sections, err = ReadFile(*path)
+		if err != nil {
+			return err
+		}
+	}
+
+	own := sections[normalize(program)]
+	for key := range own {
+		if lookup(key) == nil {
+			return fmt.Errorf("%s: unknown setting %q in [%s]", *path, key, program)
+		}
+	}
+
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil || setOnCommandLine[f.Name] || f.Name == "config" {
+			return
+		}
+
+		value, ok := os.LookupEnv(envName(program, f.Name))
+		source := envName(program, f.Name)
+		if !ok {
+			value, ok = os.LookupEnv(envName(sharedPrefix, f.Name))
+			source = envName(sharedPrefix, f.Name)
+		}
+		if !ok {
+			value, ok = own[normalize(f.Name)]
+			source = *path
+		}
+		if !ok {
+			value, ok = sections[""][normalize(f.Name)]
+			source = *path
+		}
+		if !ok {
+			return
+		}
+
+		if setErr := f.Value.Set(value); setErr != nil {
+			err = fmt.Errorf("%s: invalid value %q for %s: %v", source, value, f.Name, setErr)
+		}
+	})
+	return err
+}
+
+/** Read a config file into sections of settings. Top-level settings are in section "". **/
+func ReadFile(path string) (map[string]map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".toml" && ext != ".yaml" && ext != ".yml" {
+		return nil, fmt.Errorf("%s: config file must end in .toml, .yaml or .yml", path)
+	}
+
+	sections := map[string]map[string]string{"": {}}
+	section := ""
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		raw := stripComment(scanner.Text())
+		line := strings.TrimSpace(raw)
+		if line == "" {
+			continue
+		}
+
+		var key, value string
+		if ext == ".toml" {
+			if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+				section = normalize(strings.Trim(line, "[] "))
+				if sections[section] == nil {
+					sections[section] = map[string]string{}
+				}
+				continue
+			}
+
+			k, v, found := strings.Cut(line, "=")
+			if !found {
+				return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNum)
+			}
+			key, value = k, v
+
+		} else { // YAML
+			k, v, found := strings.Cut(line, ":")
+			if !found {
+				return nil, fmt.Errorf("%s:%d: expected key: value", path, lineNum)
+			}
+
+			indented := raw[0] == ' ' || raw[0] == '\t'
+			if !indented {
+				section = ""
+			}
+			if !indented && strings.TrimSpace(v) == "" { // start of a program's section
+				section = normalize(k)
+				if sections[section] == nil {
+					sections[section] = map[string]string{}
+				}
+				continue
+			}
+			key, value = k, v
+		}
+
+		value, err := unquote(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+		sections[section][normalize(key)] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+/** Return the flag whose normalized name is key, or nil. **/
+func lookup(key string) *flag.Flag {
+	var found *flag.Flag
+	flag.VisitAll(func(f *flag.Flag) {
+		if normalize(f.Name) == key {
+			found = f
+		}
+	})
+	return found
+}
+
+/** Settings match flags ignoring case, "-" and "_", so max_clients sets -maxclients. **/
+func normalize(name string) string {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.ReplaceAll(name, "-", "")
+	return strings.ReplaceAll(name, "_", "")
+}
+
+/** Environment variable for a flag, e.g. CHATCLIENT_SERVER. **/
+func envName(prefix string, name string) string {
+	name = strings.ReplaceAll(name, "-", "_")
+	return strings.ToUpper(prefix + "_" + name)
+}
+
+/** Remove a # comment that is not inside quotes. **/
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if quote != 0 {
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		} else if c == '"' || c == '\'' {
+			quote = c
+		} else if c == '#' {
+			return line[:i]
+		}
+	}
+	return line
+}
+
+/** Return the value of a quoted or bare scalar. Lists and tables aren't supported. **/
+func unquote(value string) (string, error) {
+	if strings.HasPrefix(value, "[") || strings.HasPrefix(value, "{") {
+		return "", fmt.Errorf("lists and tables are not supported")
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		return strconv.Unquote(value)
+	}
+	if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+		return value[1 : len(value)-1], nil
+	}
+	return value, nil
+}
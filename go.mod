@@ -0,0 +1,3 @@
+module github.com/young-jin-son/Network-Practice
+
+go 1.24